@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// adminCaller is who is calling the admin API, an admin user or
+// whoever holds the admin credential
+type adminCaller struct {
+	name string
+	user internal.User
+	key  bool
+}
+
+// adminCallerFromRequest accepts the "ApiKey" Authorization header when it
+// matches ADMIN_KEY, or a user authenticated by their access token. The
+// admin credential is disabled when ADMIN_KEY is unset
+func (cfg *apiConfig) adminCallerFromRequest(r *http.Request) (adminCaller, bool) {
+	if key, missing := internal.ApiKeyHeader(r.Header.Get("Authorization")); missing == nil {
+		if cfg.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminKey)) == 1 {
+			return adminCaller{name: "admin-key", key: true}, true
+		}
+		return adminCaller{}, false
+	}
+	if user, ok := userFromContext(r.Context()); ok {
+		return adminCaller{name: fmt.Sprintf("user:%d", user.Id), user: user}, true
+	}
+	return adminCaller{}, false
+}
+
+// requireAdmin lets a request through to next if the caller holds the
+// admin credential or one of their roles grants permission
+func (cfg *apiConfig) requireAdmin(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := cfg.adminCallerFromRequest(r)
+		if !ok {
+			respondWithError(w, http.StatusUnauthorized, "unauthorized")
+		} else if !caller.key && !caller.user.Can(permission) {
+			respondWithError(w, http.StatusForbidden, "forbidden")
+		} else {
+			next(w, r)
+		}
+	}
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// auditAdmin writes every request to the admin API, refused ones
+// included, to the audit log
+func (cfg *apiConfig) auditAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		actor := "anonymous"
+		if caller, ok := cfg.adminCallerFromRequest(r); ok {
+			actor = caller.name
+		}
+		err := cfg.audit.Record(internal.AuditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  actor,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Status: rec.status,
+			IP:     clientFromRequest(r).IP,
+		})
+		if err != nil {
+			log.Printf("error writing audit log: %s", err)
+		}
+	})
+}
+
+// adminRoutes returns the admin API, served under /admin. Every route
+// names the permission it needs, see requireAdmin
+func (cfg *apiConfig) adminRoutes() http.Handler {
+	admin := http.NewServeMux()
+	handle := func(pattern string, permission string, handler func(w http.ResponseWriter, r *http.Request, ctx *apiConfig)) {
+		admin.HandleFunc(pattern, cfg.requireAdmin(permission, func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, cfg)
+		}))
+	}
+	admin.HandleFunc("GET /metrics", cfg.requireAdmin(internal.PermReadMetrics, adminMetrics(cfg)))
+	admin.HandleFunc("GET /metrics/", cfg.requireAdmin(internal.PermReadMetrics, adminMetrics(cfg)))
+	admin.HandleFunc("POST /reset", cfg.requireAdmin(internal.PermResetMetrics, cfg.handlerReset))
+	handle("GET /audit", internal.PermReadAudit, listAudit)
+	handle("GET /users", internal.PermManageUsers, listUsers)
+	handle("PUT /users/{userID}/roles", internal.PermManageUsers, setUserRoles)
+	handle("DELETE /users/{userID}/sessions", internal.PermManageUsers, revokeUserSessions)
+	handle("DELETE /users/{userID}/2fa", internal.PermManageUsers, resetTwoFactor)
+	handle("POST /snapshots", internal.PermManageSnapshots, createSnapshot)
+	handle("GET /snapshots", internal.PermManageSnapshots, listSnapshots)
+	handle("GET /snapshots/{name}/verify", internal.PermManageSnapshots, verifySnapshot)
+	handle("POST /snapshots/{name}/restore", internal.PermManageSnapshots, restoreSnapshot)
+	return cfg.auditAdmin(http.StripPrefix("/admin", admin))
+}
+
+// listAudit returns the audit log, from ?since=RFC3339 if given
+func listAudit(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	since := time.Time{}
+	if param := r.URL.Query().Get("since"); param != "" {
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "since is not an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	if entries, err := ctx.audit.Entries(since); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		respondWithJSON(w, http.StatusOK, entries)
+	}
+}
+
+func respondWithSnapshotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, internal.ErrSnapshotExists):
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, internal.ErrSnapshotCorrupt):
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func createSnapshot(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	params := struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if info, err := ctx.db.CreateSnapshot(params.Name); err != nil {
+		respondWithSnapshotError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusCreated, info)
+	}
+}
+
+func listSnapshots(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	if infos, err := ctx.db.ListSnapshots(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		respondWithJSON(w, http.StatusOK, infos)
+	}
+}
+
+func verifySnapshot(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	if info, err := ctx.db.VerifySnapshot(r.PathValue("name")); err != nil {
+		respondWithSnapshotError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusOK, info)
+	}
+}
+
+func restoreSnapshot(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	if info, err := ctx.db.RestoreSnapshot(r.PathValue("name")); err != nil {
+		respondWithSnapshotError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusOK, info)
+	}
+}
+
+// listUsers returns every user to admins
+func listUsers(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	if users, err := ctx.db.GetUsers(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		respondWithJSON(w, http.StatusOK, users)
+	}
+}
+
+// setUserRoles replaces the roles of a user, honouring If-Match
+func setUserRoles(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	userId, parseErr := strconv.Atoi(r.PathValue("userID"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusNotFound, "not found")
+		return
+	}
+	params := struct {
+		Roles []string `json:"roles"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	version, verr := ifMatchVersion(r)
+	if verr != nil {
+		respondWithError(w, http.StatusPreconditionFailed, verr.Error())
+		return
+	}
+	user, err := ctx.db.SetUserRoles(userId, params.Roles, version)
+	switch {
+	case err == nil:
+		w.Header().Set("ETag", etag(user.Version))
+		respondWithJSON(w, http.StatusOK, user)
+	case errors.Is(err, internal.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, internal.ErrUnknownRole):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, internal.ErrVersionMismatch):
+		respondWithError(w, http.StatusPreconditionFailed, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+// revokeUserSessions logs a user out everywhere
+func revokeUserSessions(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	userId, parseErr := strconv.Atoi(r.PathValue("userID"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if _, err := ctx.db.GetUser(userId); err != nil {
+		respondWithError(w, http.StatusNotFound, "not found")
+	} else if _, err := ctx.db.RevokeAllSessions(userId); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		respondWithNoContent(w)
+	}
+}
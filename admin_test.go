@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+func TestAdminAPI(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.adminKey = "admin-secret"
+	admin, _ := s.db.CreateUser("admin@example.com", []byte("pw"))
+	admin, _ = s.db.SetUserRoles(admin.Id, []string{internal.RoleAdmin}, 0)
+	adminToken := s.token(t, admin)
+	mod, _ := s.db.CreateUser("mod@example.com", []byte("pw"))
+	mod, _ = s.db.SetUserRoles(mod.Id, []string{internal.RoleModerator}, 0)
+	modToken := s.token(t, mod)
+
+	do := func(method string, path string, authorization string) int {
+		return s.do(method, path, authorization, "").Code
+	}
+	for _, c := range []struct {
+		method, path, authorization string
+		want                        int
+	}{
+		{"GET", "/admin/users", "", http.StatusUnauthorized},
+		{"GET", "/admin/users", "ApiKey wrong", http.StatusUnauthorized},
+		{"GET", "/admin/users", "Bearer " + modToken, http.StatusForbidden},
+		{"GET", "/admin/users", "ApiKey admin-secret", http.StatusOK},
+		{"GET", "/admin/users", "Bearer " + adminToken, http.StatusOK},
+		{"GET", "/admin/metrics", "Bearer " + adminToken, http.StatusOK},
+		{"POST", "/admin/reset", "ApiKey admin-secret", http.StatusOK},
+		{"GET", "/admin/snapshots", "Bearer " + adminToken, http.StatusOK},
+	} {
+		if code := do(c.method, c.path, c.authorization); code != c.want {
+			t.Fatalf("%s %s with %q: expected %d, got %d", c.method, c.path, c.authorization, c.want, code)
+		}
+	}
+
+	entries, _ := s.cfg.audit.Entries(time.Time{})
+	if len(entries) != 8 {
+		t.Fatalf("expected 8 audit entries, got %v", entries)
+	}
+	if e := entries[0]; e.Actor != "anonymous" || e.Status != http.StatusUnauthorized || e.Path != "/admin/users" {
+		t.Fatalf("refused request audited wrong %v", e)
+	}
+	if e := entries[2]; e.Actor != "user:2" || e.Status != http.StatusForbidden {
+		t.Fatalf("moderator audited wrong %v", e)
+	}
+	if e := entries[6]; e.Actor != "admin-key" || e.Method != "POST" || e.Path != "/admin/reset" {
+		t.Fatalf("reset audited wrong %v", e)
+	}
+
+	// the admin credential is disabled without ADMIN_KEY
+	s.cfg.adminKey = ""
+	if code := do("GET", "/admin/users", "ApiKey "); code != http.StatusUnauthorized {
+		t.Fatalf("expected an empty admin key to be refused, got %d", code)
+	}
+}
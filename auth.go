@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+type contextKey int
+
+const authContextKey contextKey = iota
+
+// authResult is what authenticate found out about the caller.
+// accessToken is set when they used a personal access token
+type authResult struct {
+	user        internal.User
+	accessToken *internal.AccessToken
+	err         error
+}
+
+var errUnauthenticated = errors.New("unauthorized")
+
+// authenticate is middleware that validates a Bearer access token, a JWT
+// or a personal access token, and puts its user in the request context.
+// It never rejects a request, refresh tokens travel as Bearer tokens too,
+// handlers that need a user call requireUser
+func (cfg *apiConfig) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerToken, herr := GetTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+		if herr != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result := authResult{}
+		if strings.HasPrefix(headerToken, internal.AccessTokenPrefix) {
+			result.user, result.accessToken, result.err = cfg.userFromAccessToken(headerToken)
+		} else {
+			result.user, result.err = cfg.userFromToken(headerToken)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey, result)))
+	})
+}
+
+func (cfg *apiConfig) userFromToken(headerToken string) (internal.User, error) {
+	claims := internal.MyCustomClaims{}
+	token, err := internal.ValidateToken(headerToken, cfg.jwtKeys, &claims)
+	if err != nil || !token.Valid || claims.Purpose != "" {
+		return internal.User{}, errUnauthenticated
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return internal.User{}, errUnauthenticated
+	}
+	user, err := cfg.db.GetUser(userId)
+	if err != nil {
+		return internal.User{}, errUnauthenticated
+	}
+	user.Roles = grantedRoles(claims.Roles, user.Roles)
+	return user, nil
+}
+
+// userFromAccessToken returns the user of a personal access token,
+// stripped of their roles
+func (cfg *apiConfig) userFromAccessToken(headerToken string) (internal.User, *internal.AccessToken, error) {
+	user, at, err := cfg.db.UseAccessToken(headerToken)
+	if err != nil {
+		return internal.User{}, nil, errUnauthenticated
+	}
+	user.Roles = nil
+	return user, &at, nil
+}
+
+// grantedRoles are the roles of the token the user still has, so a
+// demotion takes effect at once and a promotion with the next token
+func grantedRoles(claimed []string, current []string) []string {
+	roles := []string{}
+	for _, role := range claimed {
+		if slices.Contains(current, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// userFromContext returns the user authenticated by the request's access token
+func userFromContext(ctx context.Context) (internal.User, bool) {
+	result, ok := ctx.Value(authContextKey).(authResult)
+	if !ok || result.err != nil {
+		return internal.User{}, false
+	}
+	return result.user, true
+}
+
+// accessTokenFromContext returns the personal access token the request
+// was authenticated with, nil for a JWT
+func accessTokenFromContext(ctx context.Context) *internal.AccessToken {
+	result, _ := ctx.Value(authContextKey).(authResult)
+	return result.accessToken
+}
+
+// requireUser returns the authenticated caller or writes a 401
+func requireUser(w http.ResponseWriter, r *http.Request) (internal.User, bool) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, errUnauthenticated.Error())
+	}
+	return user, ok
+}
+
+// requireScope returns the authenticated caller or writes a 401, or a 403
+// if they used a personal access token without scope. JWTs have every scope
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) (internal.User, bool) {
+	user, ok := requireUser(w, r)
+	if at := accessTokenFromContext(r.Context()); ok && at != nil && !at.HasScope(scope) {
+		respondWithError(w, http.StatusForbidden, "token lacks the "+scope+" scope")
+		return user, false
+	}
+	return user, ok
+}
+
+// requireLogin returns the caller authenticated by a JWT or writes a 401,
+// or a 403 for a personal access token. Sessions and tokens can only be
+// managed after logging in with a password
+func requireLogin(w http.ResponseWriter, r *http.Request) (internal.User, bool) {
+	user, ok := requireUser(w, r)
+	if ok && accessTokenFromContext(r.Context()) != nil {
+		respondWithError(w, http.StatusForbidden, "personal access tokens cannot do this, log in")
+		return user, false
+	}
+	return user, ok
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+func TestRequireUser(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := s.db.CreateUser("a@example.com", []byte("pw"))
+	token := s.token(t, user)
+	s.db.UserLogin("a@example.com", []byte("pw"), "refresh", time.Hour, internal.Client{})
+
+	post := func(path string, authorization string) *httptest.ResponseRecorder {
+		return s.do("POST", path, authorization, `{"body":"hello"}`)
+	}
+	for _, authorization := range []string{"", "Bearer not-a-jwt", "ApiKey " + token} {
+		if w := post("/api/chirps", authorization); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "error") {
+			t.Fatalf("expected a 401 body for %q, got %d %s", authorization, w.Code, w.Body)
+		}
+	}
+	if w := post("/api/chirps", "Bearer "+token); w.Code != http.StatusCreated {
+		t.Fatalf("expected the chirp to be created, got %d %s", w.Code, w.Body)
+	}
+	if w := post("/api/refresh", "Bearer refresh"); w.Code != http.StatusOK {
+		t.Fatalf("middleware got in the way of a refresh token, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	s := newTestServer(t)
+	tokenFor := func(email string, roles ...string) (internal.User, string) {
+		user, _ := s.db.CreateUser(email, []byte("pw"))
+		if len(roles) > 0 {
+			user, _ = s.db.SetUserRoles(user.Id, roles, 0)
+		}
+		return user, s.token(t, user)
+	}
+	author, authorToken := tokenFor("author@example.com")
+	admin, adminToken := tokenFor("admin@example.com", internal.RoleAdmin)
+	_, modToken := tokenFor("mod@example.com", internal.RoleModerator)
+	do := func(method string, path string, token string) int {
+		return s.do(method, path, "Bearer "+token, "").Code
+	}
+
+	first, _ := s.db.CreateChirp("first", author)
+	second, _ := s.db.CreateChirp("second", author)
+	if code := do("DELETE", fmt.Sprintf("/api/chirps/%d", first.Id), adminToken+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d", code)
+	}
+	if code := do("DELETE", fmt.Sprintf("/api/chirps/%d", first.Id), modToken); code != http.StatusNoContent {
+		t.Fatalf("moderator couldnt delete a chirp, got %d", code)
+	}
+	if code := do("DELETE", fmt.Sprintf("/api/chirps/%d", second.Id), adminToken); code != http.StatusNoContent {
+		t.Fatalf("admin couldnt delete a chirp, got %d", code)
+	}
+
+	for token, want := range map[string]int{authorToken: http.StatusForbidden, modToken: http.StatusForbidden, adminToken: http.StatusOK} {
+		if code := do("POST", "/admin/reset", token); code != want {
+			t.Fatalf("expected %d resetting metrics, got %d", want, code)
+		}
+		if code := do("GET", "/admin/users", token); code != want {
+			t.Fatalf("expected %d listing users, got %d", want, code)
+		}
+	}
+
+	// demoted admins lose their permissions before their token expires
+	s.db.SetUserRoles(admin.Id, nil, 0)
+	if code := do("GET", "/admin/users", adminToken); code != http.StatusForbidden {
+		t.Fatalf("expected 403 after demotion, got %d", code)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// runCommand runs a chirpy subcommand instead of the server
+func runCommand(dbPath string, opts internal.Options, args []string) error {
+	switch args[0] {
+	case "restore":
+		return restoreCommand(dbPath, opts, args[1:])
+	case "migrate":
+		return migrateCommand(dbPath, opts, args[1:])
+	case "snapshot":
+		return snapshotCommand(dbPath, opts, args[1:])
+	case "fsck":
+		return fsckCommand(dbPath, opts, args[1:])
+	case "reencrypt":
+		return reencryptCommand(dbPath, opts)
+	case "encryption-key":
+		return encryptionKeyCommand()
+	case "jwt-key":
+		return jwtKeyCommand(args[1:])
+	case "role":
+		return roleCommand(dbPath, opts, args[1:])
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// restoreCommand rewinds the database to its state at a point in time,
+// the server must be stopped since it holds the database lock
+func restoreCommand(dbPath string, opts internal.Options, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	at := fs.String("at", "", "RFC 3339 time to restore the database to")
+	fs.Parse(args)
+	t, err := time.Parse(time.RFC3339, *at)
+	if err != nil {
+		return fmt.Errorf("invalid -at time: %w", err)
+	}
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.RestoreTo(t); err != nil {
+		return err
+	}
+	fmt.Printf("restored %s to %s\n", dbPath, t.Format(time.RFC3339))
+	return nil
+}
+
+// migrateCommand upgrades the database to the current schema, with
+// -dry-run it only reports the migrations and the records they would change
+func migrateCommand(dbPath string, opts internal.Options, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report pending migrations without running them")
+	fs.Parse(args)
+	changes, err := internal.PlanMigrations(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Println("database is up to date")
+		return nil
+	}
+	for _, c := range changes {
+		fmt.Printf("migration %d: %s (%d records)\n", c.Version, c.Description, len(c.Changed))
+		for _, record := range c.Changed {
+			fmt.Printf("  %s\n", record)
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// fsckCommand reports inconsistencies in the database, with -repair it
+// also fixes those that have a safe fix. It fails while any remain
+func fsckCommand(dbPath string, opts internal.Options, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix the problems that can be fixed safely")
+	fs.Parse(args)
+	var problems []internal.Problem
+	var err error
+	if *repair {
+		problems, err = repairDB(dbPath, opts)
+	} else {
+		problems, err = internal.CheckFile(dbPath, opts)
+	}
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, p := range problems {
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		} else {
+			remaining++
+		}
+		fmt.Printf("%s\t%s\t%s%s\n", p.Category, p.Record, p.Message, status)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+	fmt.Printf("%s ok\n", dbPath)
+	return nil
+}
+
+// repairDB opens the database for writing and repairs it
+func repairDB(dbPath string, opts internal.Options) ([]internal.Problem, error) {
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Check(true)
+}
+
+// reencryptCommand rewrites the database with the newest encryption key,
+// use it to encrypt a plaintext database or to finish a key rotation
+func reencryptCommand(dbPath string, opts internal.Options) error {
+	if opts.EncryptionKeys == nil {
+		return fmt.Errorf("set DB_ENCRYPTION_KEYS or DB_ENCRYPTION_KEY_FILE to reencrypt")
+	}
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Reencrypt(); err != nil {
+		return err
+	}
+	fmt.Printf("reencrypted %s\n", dbPath)
+	return nil
+}
+
+// encryptionKeyCommand prints a new random key for DB_ENCRYPTION_KEYS
+func encryptionKeyCommand() error {
+	key, err := internal.NewEncryptionKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s:%s\n", time.Now().UTC().Format("20060102"), key)
+	return nil
+}
+
+// snapshotCommand manages named snapshots:
+// snapshot create NAME | list | verify NAME | restore NAME
+func snapshotCommand(dbPath string, opts internal.Options, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: snapshot create NAME | list | verify NAME | restore NAME")
+	}
+	if args[0] != "list" && len(args) != 2 {
+		return fmt.Errorf("usage: snapshot %s NAME", args[0])
+	}
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var info internal.SnapshotInfo
+	switch args[0] {
+	case "list":
+		infos, err := db.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			fmt.Printf("%s\t%s\t%d bytes\n", info.Name, info.CreatedAt.Format(time.RFC3339), info.Size)
+		}
+		return nil
+	case "create":
+		info, err = db.CreateSnapshot(args[1])
+	case "verify":
+		info, err = db.VerifySnapshot(args[1])
+	case "restore":
+		info, err = db.RestoreSnapshot(args[1])
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s ok (sha256 %s)\n", args[0], info.Name, info.Checksum)
+	return nil
+}
+
+// jwtKeyCommand manages the access token signing keys in JWT_KEYS_DIR:
+// jwt-key new [-alg RS256|EdDSA] [-pending] | list | activate KID | retire KID.
+// Running servers pick changes up within a minute
+func jwtKeyCommand(args []string) error {
+	usage := fmt.Errorf("usage: jwt-key new [-alg RS256|EdDSA] [-pending] | list | activate KID | retire KID")
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return fmt.Errorf("set JWT_KEYS_DIR to manage jwt keys")
+	}
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "new":
+		fs := flag.NewFlagSet("jwt-key new", flag.ExitOnError)
+		alg := fs.String("alg", "EdDSA", "signing algorithm, RS256 or EdDSA")
+		pending := fs.Bool("pending", false, "publish the key without signing with it yet")
+		fs.Parse(args[1:])
+		state := internal.KeyActive
+		if *pending {
+			state = internal.KeyPending
+		}
+		id, err := internal.GenerateKey(dir, *alg, state)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\t%s\n", id, *alg, state)
+		return nil
+	case "list":
+		keys, err := internal.LoadKeyring(dir, "")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys.Keys() {
+			fmt.Printf("%s\t%s\t%s\n", key.Id, key.Method.Alg(), key.State)
+		}
+		return nil
+	case "activate", "retire":
+		if len(args) != 2 {
+			return usage
+		}
+		state := internal.KeyActive
+		if args[0] == "retire" {
+			state = internal.KeyRetired
+		}
+		if err := internal.SetKeyState(dir, args[1], state); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", args[1], state)
+		return nil
+	}
+	return usage
+}
+
+// roleCommand manages user roles, the way to appoint the first admin:
+// role grant EMAIL ROLE | revoke EMAIL ROLE | list
+func roleCommand(dbPath string, opts internal.Options, args []string) error {
+	usage := fmt.Errorf("usage: role grant EMAIL ROLE | revoke EMAIL ROLE | list")
+	if len(args) == 0 || (args[0] != "list" && len(args) != 3) {
+		return usage
+	}
+	db, err := internal.OpenDB(dbPath, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if args[0] == "list" {
+		users, err := db.GetUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if len(user.Roles) > 0 {
+				fmt.Printf("%d\t%s\t%s\n", user.Id, user.Email, strings.Join(user.Roles, ","))
+			}
+		}
+		return nil
+	}
+	var user internal.User
+	err = db.View(func(tx *internal.Tx) error {
+		u, ok := tx.UserByEmail(args[1])
+		if !ok {
+			return fmt.Errorf("no user %s", args[1])
+		}
+		user = u
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	roles := slices.DeleteFunc(slices.Clone(user.Roles), func(role string) bool { return role == args[2] })
+	switch args[0] {
+	case "grant":
+		roles = append(roles, args[2])
+	case "revoke":
+	default:
+		return usage
+	}
+	if user, err = db.SetUserRoles(user.Id, roles, user.Version); err != nil {
+		return err
+	}
+	fmt.Printf("%s roles: %s\n", user.Email, strings.Join(user.Roles, ","))
+	return nil
+}
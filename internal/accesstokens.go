@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes limit what a personal access token may do
+const (
+	ScopeChirpsWrite = "chirps:write"
+	ScopeUsersRead   = "users:read"
+	ScopeUsersWrite  = "users:write"
+)
+
+var scopes = []string{ScopeChirpsWrite, ScopeUsersRead, ScopeUsersWrite}
+
+// AccessTokenPrefix starts every personal access token, so they can't be
+// mistaken for a JWT or a refresh token
+const AccessTokenPrefix = "chirpy_pat_"
+
+// accessTokenTouchEvery is how stale LastUsedAt may get before a use of
+// the token is written, so busy scripts don't log a write per request
+const accessTokenTouchEvery = time.Minute
+
+var (
+	ErrUnknownScope       = errors.New("unknown scope")
+	ErrAccessTokenExpired = errors.New("personal access token expired")
+)
+
+// AccessToken is a long-lived personal access token, stored under the hash
+// of the token like refresh tokens. It acts as its user, without their
+// roles, within its scopes
+type AccessToken struct {
+	// Id is the hash of the token
+	Id         string     `json:"id"`
+	UserId     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// HasScope reports whether the token was granted scope
+func (t AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScopes returns scopes sorted and without duplicates, or
+// ErrUnknownScope if one of them doesn't exist or there are none
+func ValidateScopes(requested []string) ([]string, error) {
+	seen := map[string]bool{}
+	valid := []string{}
+	for _, scope := range requested {
+		known := false
+		for _, s := range scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("%w %q, use %s", ErrUnknownScope, scope, strings.Join(scopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			valid = append(valid, scope)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("%w, a token needs at least one of %s", ErrUnknownScope, strings.Join(scopes, ", "))
+	}
+	sort.Strings(valid)
+	return valid, nil
+}
+
+// CreateAccessToken stores token as a personal access token of userId,
+// valid for ttl or until it is revoked when ttl is 0
+func (db *DB) CreateAccessToken(userId int, token string, name string, requested []string, ttl time.Duration) (AccessToken, error) {
+	granted, err := ValidateScopes(requested)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if strings.TrimSpace(name) == "" {
+		return AccessToken{}, errors.New("a token needs a name")
+	}
+	now := time.Now().UTC()
+	at := AccessToken{Id: HashToken(token), UserId: userId, Name: name, Scopes: granted, CreatedAt: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		at.ExpiresAt = &expires
+	}
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.User(userId); !ok {
+			return ErrNotFound
+		}
+		return tx.PutAccessToken(at)
+	})
+	return at, err
+}
+
+// AccessTokens returns a user's personal access tokens, newest first
+func (db *DB) AccessTokens(userId int) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := db.View(func(tx *Tx) error {
+		for _, at := range tx.AccessTokens() {
+			if at.UserId == userId {
+				tokens = append(tokens, at)
+			}
+		}
+		return nil
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens, err
+}
+
+// RevokeAccessToken deletes one of a user's personal access tokens,
+// ErrNotFound if the user has no token with that id
+func (db *DB) RevokeAccessToken(userId int, id string) error {
+	return db.Update(func(tx *Tx) error {
+		at, ok := tx.AccessToken(id)
+		if !ok || at.UserId != userId {
+			return ErrNotFound
+		}
+		return tx.DeleteAccessToken(id)
+	})
+}
+
+// UseAccessToken returns the user a personal access token belongs to and
+// the token, and records that it was used
+func (db *DB) UseAccessToken(token string) (User, AccessToken, error) {
+	var user User
+	var at AccessToken
+	err := db.Update(func(tx *Tx) error {
+		t, ok := tx.AccessToken(HashToken(token))
+		if !ok {
+			return errors.New("unauthorized")
+		}
+		now := time.Now().UTC()
+		if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+			return ErrAccessTokenExpired
+		}
+		u, ok := tx.User(t.UserId)
+		if !ok {
+			return errors.New("unauthorized")
+		}
+		user, at = u, t
+		if t.LastUsedAt != nil && now.Sub(*t.LastUsedAt) < accessTokenTouchEvery {
+			return nil
+		}
+		t.LastUsedAt = &now
+		return tx.PutAccessToken(t)
+	})
+	return user, at, err
+}
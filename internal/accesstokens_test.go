@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	user, _ := db.CreateUser("a@example.com", []byte("pw"))
+	if _, err := db.CreateAccessToken(user.Id, AccessTokenPrefix+"x", "ci", []string{"chirps:everything"}, 0); !errors.Is(err, ErrUnknownScope) {
+		t.Fatalf("expected %s, got %v", ErrUnknownScope, err)
+	}
+	if _, err := db.CreateAccessToken(user.Id, AccessTokenPrefix+"x", "ci", nil, 0); !errors.Is(err, ErrUnknownScope) {
+		t.Fatalf("expected a token without scopes to be refused, got %v", err)
+	}
+	at, err := db.CreateAccessToken(user.Id, AccessTokenPrefix+"ci", "ci", []string{ScopeChirpsWrite, ScopeChirpsWrite}, 0)
+	if err != nil || len(at.Scopes) != 1 || !at.HasScope(ScopeChirpsWrite) || at.ExpiresAt != nil {
+		t.Fatalf("couldnt create token %v %v", at, err)
+	}
+	db.CreateAccessToken(user.Id, AccessTokenPrefix+"short", "short", []string{ScopeUsersRead}, time.Nanosecond)
+
+	used, usedToken, err := db.UseAccessToken(AccessTokenPrefix + "ci")
+	if err != nil || used.Id != user.Id || usedToken.Id != at.Id {
+		t.Fatalf("couldnt use token %v %v", used, err)
+	}
+	tokens, _ := db.AccessTokens(user.Id)
+	if len(tokens) != 2 || tokens[1].LastUsedAt == nil {
+		t.Fatalf("expected the use to be recorded, got %v", tokens)
+	}
+	if _, _, err := db.UseAccessToken(AccessTokenPrefix + "short"); err != ErrAccessTokenExpired {
+		t.Fatalf("expected %s, got %v", ErrAccessTokenExpired, err)
+	}
+	if _, _, err := db.UseAccessToken(AccessTokenPrefix + "guess"); err == nil {
+		t.Fatalf("accepted an unknown token")
+	}
+
+	if err := db.RevokeAccessToken(user.Id+1, at.Id); err != ErrNotFound {
+		t.Fatalf("revoked another user's token, got %v", err)
+	}
+	if err := db.RevokeAccessToken(user.Id, at.Id); err != nil {
+		t.Fatalf("couldnt revoke token %s", err)
+	}
+	if _, _, err := db.UseAccessToken(AccessTokenPrefix + "ci"); err == nil {
+		t.Fatalf("revoked token still works")
+	}
+	db.Close()
+
+	for _, suffix := range []string{"", ".wal", ".history"} {
+		b, _ := os.ReadFile(path + suffix)
+		if strings.Contains(string(b), AccessTokenPrefix) {
+			t.Fatalf("%s contains a plaintext access token", path+suffix)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json.audit")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("couldnt open audit log %s", err)
+	}
+	start := time.Now().UTC()
+	audit.Record(AuditEntry{Time: start.Add(-time.Hour), Actor: "admin-key", Method: "POST", Path: "/admin/reset", Status: 200})
+	audit.Record(AuditEntry{Time: start, Actor: "user:1", Method: "GET", Path: "/admin/users", Status: 200})
+	audit.Close()
+
+	// a torn last line is skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte(`{"time":"2024-`))
+	f.Close()
+
+	audit, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen audit log %s", err)
+	}
+	defer audit.Close()
+	if entries, err := audit.Entries(time.Time{}); err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v %v", entries, err)
+	}
+	if entries, _ := audit.Entries(start); len(entries) != 1 || entries[0].Actor != "user:1" {
+		t.Fatalf("expected the entry since %s, got %v", start, entries)
+	}
+}
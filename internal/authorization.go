@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,8 +13,16 @@ import (
 
 type MyCustomClaims struct {
 	jwt.RegisteredClaims
+	// Roles are the user's roles when the token was issued
+	Roles []string `json:"roles,omitempty"`
+	// Purpose is set on tokens that are not access tokens,
+	// see CreateTwoFactorChallenge
+	Purpose string `json:"purpose,omitempty"`
 }
 
+// PurposeTwoFactor marks the challenge between the two steps of a login
+const PurposeTwoFactor = "two-factor"
+
 func ApiKeyHeader(header string) (string, error) {
 	const prefix = "ApiKey "
 	if !strings.HasPrefix(header, prefix) {
@@ -29,27 +39,72 @@ func AuthorizationHeader(header string) (string, error) {
 	return strings.TrimSpace(strings.TrimPrefix(header, prefix)), nil
 }
 
-func CreateJwt(user *User, jwtSecret []byte, expiresInSeconds int) (string, error) {
+func CreateJwt(user *User, keys *Keyring, expiresInSeconds int) (string, error) {
 	tokenExpiration := time.Now().Add(24 * time.Hour)
 	if expiresInSeconds > 0 {
 		tokenExpiration = time.Now().Add(time.Duration(expiresInSeconds * int(time.Second)))
 	}
-	claims := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(tokenExpiration),
-		Subject:   fmt.Sprint(user.Id),
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	claims := MyCustomClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(tokenExpiration),
+			Subject:   fmt.Sprint(user.Id),
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+		Roles: user.Roles,
+	}
+	return keys.Sign(claims)
+}
+
+// NewChallengeKey returns a random HS256 key for two-factor challenges.
+// It lives only in the server's memory, unlike the keys of a Keyring
+func NewChallengeKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateTwoFactorChallenge returns a token proving user logged in with
+// their password, exchanged with a two-factor code for the access and
+// refresh tokens within ttl. It is signed with key, not with the keys
+// access tokens are signed with, so no verifier of access tokens,
+// including those using the JWKS, can mistake it for one
+func CreateTwoFactorChallenge(user *User, key []byte, ttl time.Duration) (string, error) {
+	if len(key) < MinSecretLength {
+		return "", errors.New("no two-factor challenge key")
+	}
+	now := time.Now()
+	claims := MyCustomClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			Subject:   fmt.Sprint(user.Id),
+			Issuer:    "chirpy",
+			Audience:  jwt.ClaimStrings{PurposeTwoFactor},
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Purpose: PurposeTwoFactor,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// ValidateTwoFactorChallenge returns the id of the user a challenge
+// signed with key was issued to
+func ValidateTwoFactorChallenge(challenge string, key []byte) (int, error) {
+	if len(key) < MinSecretLength {
+		return 0, errors.New("no two-factor challenge key")
+	}
+	claims := MyCustomClaims{}
+	token, err := jwt.ParseWithClaims(challenge, &claims, func(*jwt.Token) (any, error) { return key, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(PurposeTwoFactor))
+	if err != nil || !token.Valid || claims.Purpose != PurposeTwoFactor {
+		return 0, errors.New("invalid or expired challenge")
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return strconv.Atoi(claims.Subject)
 }
 
-func ValidateToken(headerToken string, jwtSecret []byte, claims *MyCustomClaims) (*jwt.Token, error) {
-	token, err := jwt.ParseWithClaims(headerToken, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("theres a problem with the signing method")
-		}
-		return jwtSecret, nil
-	})
-	return token, err
+// ValidateToken parses a token signed with any active key of the keyring
+func ValidateToken(headerToken string, keys *Keyring, claims *MyCustomClaims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(headerToken, claims, keys.Keyfunc)
 }
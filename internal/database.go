@@ -1,277 +1,866 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path    string
+	mux     *sync.RWMutex
+	backend backend
+	data    DBStructure
+	index   indexes
+	seq     int64
 }
 
+// compactEvery is the number of log records after which the
+// snapshot is rewritten and the write-ahead log emptied
+const compactEvery = 1000
+
 type Chirp struct {
 	Id       int    `json:"id"`
 	Body     string `json:"body"`
 	AuthorId int    `json:"author_id"`
+	// DeletedAt marks a tombstone, deleted chirps are hidden until
+	// they are restored or purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy int        `json:"deleted_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// Version counts the writes to the chirp, see Tx.PutChirp
+	Version int `json:"version"`
 }
 
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrForbidden     = errors.New("forbidden")
+	ErrWindowExpired = errors.New("undelete window expired")
+	ErrEmailTaken    = errors.New("email already in use")
+)
+
 type DBStructure struct {
-	Chirps        map[int]Chirp  `json:"chirps"`
-	Users         map[int]User   `json:"users"`
-	Passwords     map[int][]byte `json:"passwords"`
-	RefreshTokens map[string]int `json:"refresh_tokens"`
+	// Version is the schema version, see migrations
+	Version       int                     `json:"version"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	Passwords     map[int][]byte          `json:"passwords"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	AccessTokens  map[string]AccessToken  `json:"access_tokens"`
+	TwoFactor     map[int]TwoFactor       `json:"two_factor"`
+	// Sequences holds the last ID handed out per table, IDs are never reused
+	Sequences map[string]int `json:"sequences"`
+	// LogSeq is the seq of the last log record included in a snapshot
+	LogSeq int64 `json:"log_seq,omitempty"`
 }
 
 type User struct {
-	Email       string `json:"email"`
-	Id          int    `json:"id"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Email       string    `json:"email"`
+	Id          int       `json:"id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Roles       []string  `json:"roles,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Version counts the writes to the user, see Tx.PutUser
+	Version int `json:"version"`
+}
+
+// Options configure how OpenDB stores the database file
+type Options struct {
+	// EncryptionKeys encrypt the snapshot and logs at rest when set
+	EncryptionKeys *EncryptionKeys
 }
 
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
+// NewDB opens the database file with the default options, see OpenDB
 func NewDB(path string) (*DB, error) {
-	db := DB{path, &sync.RWMutex{}}
-	db.ensureDB()
-	return &db, nil
+	return OpenDB(path, Options{})
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, author User) (Chirp, error) {
-	newChirp := Chirp{Body: body, Id: -1, AuthorId: author.Id}
-	if dbStructure, err := db.loadDB(); err == nil {
-		for i := range dbStructure.Chirps {
-			if _, ok := dbStructure.Chirps[i]; !ok {
-				newChirp.Id = i
-				break
-			}
+// OpenDB opens the database file, creating it if it doesn't exist,
+// and loads it into memory, replaying the write-ahead log next to it.
+// The returned DB is meant to be shared by every handler for the lifetime
+// of the process. OpenDB fails if another DB, in this or any other
+// process, has the file open
+func OpenDB(path string, opts Options) (*DB, error) {
+	fb, err := openFileBackend(path, opts.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(path, fb)
+	if err != nil {
+		fb.close()
+	}
+	return db, err
+}
+
+// RemoveDB deletes the database file at path along with its log and
+// history, named snapshots are kept. It fails if the database is open
+func RemoveDB(path string) error {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+	for _, p := range []string{path, path + ".wal", path + ".history"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMemoryDB creates a database that is never written to disk
+func NewMemoryDB() *DB {
+	db, _ := openDB("", &memoryBackend{})
+	return db
+}
+
+// openDB loads the database from b and upgrades it to the current schema
+func openDB(path string, b backend) (*DB, error) {
+	state, seq, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrate(state)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{path: path, mux: &sync.RWMutex{}, backend: b, data: data, index: buildIndexes(data), seq: seq}
+	if len(applied) > 0 {
+		if err := db.commitSnapshot(data); err != nil {
+			return nil, err
 		}
-		if newChirp.Id == -1 {
-			newChirp.Id = len(dbStructure.Chirps) + 1
+		if err := db.scrub(applied); err != nil {
+			return nil, err
 		}
+	}
+	return db, nil
+}
+
+// scrub takes the secrets the applied migrations removed out of the
+// history and the named snapshots, after the migration was committed
+func (db *DB) scrub(applied []Migration) error {
+	history, err := db.backend.history()
+	if err != nil {
+		return err
+	}
+	history, changed, err := scrubHistory(history, applied)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := db.backend.rewriteHistory(history); err != nil {
+			return err
+		}
+	}
+	return db.scrubSnapshots(applied)
+}
+
+// Close compacts the log and releases the database file,
+// the DB must not be used afterwards
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	cerr := db.compact()
+	if err := db.backend.close(); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// commit appends ops to the write-ahead log as a single record and then
+// applies them in memory, callers must hold the write lock
+func (db *DB) commit(ops ...op) error {
+	rec := logRecord{Seq: db.seq + 1, Time: time.Now().UTC(), Ops: ops}
+	if err := db.backend.append(rec); err != nil {
+		return err
+	}
+	db.seq = rec.Seq
+	for _, o := range ops {
+		if err := db.apply(o); err != nil {
+			return err
+		}
+	}
+	if db.backend.logSize() >= compactEvery {
+		if err := db.compact(); err != nil {
+			log.Printf("error compacting database: %s", err)
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the snapshot from memory and empties the write-ahead log
+func (db *DB) Compact() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	db.data.LogSeq = db.seq
+	return db.backend.compact(db.data)
+}
+
+// Reencrypt rewrites the snapshot and the whole history with the newest
+// encryption key, so nothing sealed with an older key or left in plaintext
+// remains on disk. Run it after adding a key, then retire the old ones
+func (db *DB) Reencrypt() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	db.data.LogSeq = db.seq
+	return db.backend.reencrypt(db.data)
+}
+
+// RestoreTo rewinds the database to its state at t. The restore is itself
+// logged, so the history after t is kept and can be restored again
+func (db *DB) RestoreTo(t time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	history, err := db.backend.history()
+	if err != nil {
+		return err
+	}
+	restored, err := stateAt(history, t)
+	if err != nil {
+		return err
+	}
+	return db.commitSnapshot(restored)
+}
 
-		dbStructure.Chirps[newChirp.Id] = newChirp
-		werr := db.writeDB(dbStructure)
-		return newChirp, werr
+// commitSnapshot replaces the whole database with data, logging it as a
+// snapshot record, callers must hold the write lock
+func (db *DB) commitSnapshot(data DBStructure) error {
+	// restores must not rewind the sequences, IDs are never reused
+	sequences := make(map[string]int, len(data.Sequences))
+	for table, last := range data.Sequences {
+		sequences[table] = last
+	}
+	for table, last := range db.data.Sequences {
+		sequences[table] = max(sequences[table], last)
+	}
+	data.Sequences = sequences
+	j, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	rec := logRecord{Seq: db.seq + 1, Time: time.Now().UTC(), Snapshot: j}
+	if err := db.backend.append(rec); err != nil {
+		return err
 	}
-	return newChirp, nil
+	db.seq = rec.Seq
+	db.data = data
+	db.index = buildIndexes(data)
+	return db.compact()
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(body string, author User) (Chirp, error) {
+	var newChirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		id, err := tx.NextId("chirps")
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if err := tx.PutChirp(Chirp{Body: body, Id: id, AuthorId: author.Id, CreatedAt: now, UpdatedAt: now}); err != nil {
+			return err
+		}
+		newChirp, _ = tx.Chirp(id)
+		return nil
+	})
+	return newChirp, err
 }
 
 // GetChirp returns one chirp from the database
 func (db *DB) GetChirp(chirpId int) (Chirp, error) {
-	data, err := db.loadDB()
-	chirp := Chirp{}
-	if err == nil {
-		for _, val := range data.Chirps {
-			if val.Id == chirpId {
-				return val, nil
-			}
+	var chirp Chirp
+	err := db.View(func(tx *Tx) error {
+		if c, ok := tx.Chirp(chirpId); ok && c.DeletedAt == nil {
+			chirp = c
+			return nil
 		}
-		return chirp, errors.New("not found")
-	}
+		return ErrNotFound
+	})
 	return chirp, err
 }
 
-func (db *DB) DeleteChirp(chirpId int, userId int) bool {
-	data, err := db.loadDB()
-	if err == nil {
-		chirp := data.Chirps[chirpId]
-		if chirp.AuthorId == userId {
-			delete(data.Chirps, chirpId)
-			return true
+// DeleteChirp turns a chirp into a tombstone if it belongs to by
+// or by may moderate chirps.
+// A non zero version must match the chirp's or ErrVersionMismatch is returned
+func (db *DB) DeleteChirp(chirpId int, by User, version int) error {
+	return db.Update(func(tx *Tx) error {
+		chirp, ok := tx.Chirp(chirpId)
+		if !ok || chirp.DeletedAt != nil {
+			return ErrNotFound
+		}
+		if chirp.AuthorId != by.Id && !by.Can(PermModerateChirp) {
+			return ErrForbidden
+		}
+		if version != 0 && chirp.Version != version {
+			return ErrVersionMismatch
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		chirp.DeletedBy = by.Id
+		return tx.PutChirp(chirp)
+	})
+}
+
+// RestoreChirp undeletes a chirp for its author, as long as it was
+// deleted less than window ago and not removed by a moderator
+func (db *DB) RestoreChirp(chirpId int, userId int, window time.Duration) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		c, ok := tx.Chirp(chirpId)
+		if !ok || c.DeletedAt == nil {
+			return ErrNotFound
 		}
+		if c.AuthorId != userId || (c.DeletedBy != 0 && c.DeletedBy != userId) {
+			return ErrForbidden
+		}
+		if time.Since(*c.DeletedAt) > window {
+			return ErrWindowExpired
+		}
+		c.DeletedAt = nil
+		c.DeletedBy = 0
+		if err := tx.PutChirp(c); err != nil {
+			return err
+		}
+		chirp, _ = tx.Chirp(chirpId)
+		return nil
+	})
+	return chirp, err
+}
+
+// PurgeDeletedChirps removes the tombstones of chirps deleted more than
+// retention ago for good and returns how many it removed
+func (db *DB) PurgeDeletedChirps(retention time.Duration) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, chirp := range tx.Chirps() {
+			if chirp.DeletedAt != nil && time.Since(*chirp.DeletedAt) > retention {
+				if err := tx.DeleteChirp(chirp.Id); err != nil {
+					return err
+				}
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return false
+	return purged, nil
 }
 
 // GetChirps returns all chirps in the database
-func (db *DB) GetChirps(params struct {
-	AuthorId int
-	Sort     string
-},
-) ([]Chirp, error) {
-	data, _ := db.loadDB()
+func (db *DB) GetChirps(params ChirpsParams) ([]Chirp, error) {
 	values := make([]Chirp, 0)
-	for _, val := range data.Chirps {
+	err := db.View(func(tx *Tx) error {
+		var chirps []Chirp
 		if params.AuthorId > 0 {
-			if val.AuthorId == params.AuthorId {
+			chirps = tx.ChirpsByAuthor(params.AuthorId)
+		} else {
+			chirps = tx.Chirps()
+		}
+		for _, val := range chirps {
+			if val.DeletedAt == nil {
 				values = append(values, val)
 			}
-		} else {
-			values = append(values, val)
 		}
-	}
+		return nil
+	})
 	if params.Sort == "desc" {
 		sort.Slice(values, func(i, j int) bool {
 			return values[i].Id > values[j].Id
 		})
+	} else if params.Sort == "created_at" {
+		// backfilled chirps share a created_at, ties keep id order
+		sort.Slice(values, func(i, j int) bool {
+			if !values[i].CreatedAt.Equal(values[j].CreatedAt) {
+				return values[i].CreatedAt.Before(values[j].CreatedAt)
+			}
+			return values[i].Id < values[j].Id
+		})
 	} else {
 		sort.Slice(values, func(i, j int) bool {
 			return values[i].Id < values[j].Id
 		})
 	}
 
-	return values, nil
+	return values, err
 }
 
 func (db *DB) GetUser(userId int) (User, error) {
-	if dbStructure, err := db.loadDB(); err == nil {
-		return dbStructure.Users[userId], nil
-	} else {
-		return User{}, errors.New("not found")
-	}
+	var user User
+	err := db.View(func(tx *Tx) error {
+		u, ok := tx.User(userId)
+		if !ok {
+			return ErrNotFound
+		}
+		user = u
+		return nil
+	})
+	return user, err
 }
 
 func (db *DB) UpgradeUserRed(userId int, red bool) bool {
-	if dbStructure, err := db.loadDB(); err == nil {
-		if user, ok := dbStructure.Users[userId]; ok {
-			user.IsChirpyRed = red
-			dbStructure.Users[userId] = user
+	err := db.Update(func(tx *Tx) error {
+		user, ok := tx.User(userId)
+		if !ok {
+			return ErrNotFound
+		}
+		if user.IsChirpyRed == red {
+			return nil
+		}
+		user.IsChirpyRed = red
+		user.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(user)
+	})
+	return err == nil
+}
 
-			db.writeDB(dbStructure)
-			return true
-		} else {
-			return false
+// UpdateUser changes a user's email and password. A non zero version must
+// match the user's or ErrVersionMismatch is returned
+func (db *DB) UpdateUser(userId int, email string, password []byte, version int) (User, error) {
+	pw, err := bcrypt.GenerateFromPassword(password, 10)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = db.Update(func(tx *Tx) error {
+		u, ok := tx.User(userId)
+		if !ok {
+			return ErrNotFound
 		}
-	} else {
-		return false
+		if version != 0 && u.Version != version {
+			return ErrVersionMismatch
+		}
+		if owner, taken := tx.UserByEmail(email); taken && owner.Id != userId {
+			return ErrEmailTaken
+		}
+		u.Email = email
+		u.UpdatedAt = time.Now().UTC()
+		if err := tx.PutUser(u); err != nil {
+			return err
+		}
+		user, _ = tx.User(userId)
+		return tx.PutPassword(userId, pw)
+	})
+	return user, err
+}
+
+func (db *DB) CreateUser(email string, password []byte) (User, error) {
+	pw, err := bcrypt.GenerateFromPassword(password, 10)
+	if err != nil {
+		return User{}, err
 	}
+	var newUser User
+	err = db.Update(func(tx *Tx) error {
+		if _, taken := tx.UserByEmail(email); taken {
+			return ErrEmailTaken
+		}
+		id, err := tx.NextId("users")
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if err := tx.PutUser(User{Email: email, Id: id, IsChirpyRed: false, CreatedAt: now, UpdatedAt: now}); err != nil {
+			return err
+		}
+		newUser, _ = tx.User(id)
+		return tx.PutPassword(id, pw)
+	})
+	return newUser, err
 }
 
-func (db *DB) UpdateUser(userId int, email string, password []byte) (User, error) {
-	newUser := User{Email: email, Id: userId}
-	var erred error
-	if dbStructure, err := db.loadDB(); err == nil {
-		if user, ok := dbStructure.Users[userId]; !ok {
-			erred = errors.New("not found")
-		} else {
-			if pw, pwerr := bcrypt.GenerateFromPassword(password, 10); pwerr == nil {
-				dbStructure.Passwords[user.Id] = pw
-			} else {
-				erred = pwerr
-			}
-			dbStructure.Users[user.Id] = newUser
-			if werr := db.writeDB(dbStructure); werr != nil {
-				erred = werr
-			}
+// UserLogin checks a user's password and issues them the refresh token
+// refresh, valid for ttl, as the first of a new token family. Users with
+// two-factor authentication get ErrTwoFactorRequired and no token, they
+// finish logging in with TwoFactorLogin
+func (db *DB) UserLogin(email string, password []byte, refresh string, ttl time.Duration, client Client) (User, error) {
+	var user User
+	var pw []byte
+	err := db.View(func(tx *Tx) error {
+		u, ok := tx.UserByEmail(email)
+		if !ok {
+			return errors.New("db error")
 		}
-	} else {
-		erred = err
+		user = u
+		pw, _ = tx.Password(u.Id)
+		return nil
+	})
+	if err != nil {
+		return user, err
+	}
+	// bcrypt is slow on purpose, comparing outside the lock keeps a flood
+	// of logins from stalling every other request
+	if err := bcrypt.CompareHashAndPassword(pw, password); err != nil {
+		return user, err
 	}
-	return newUser, erred
+	err = db.Update(func(tx *Tx) error {
+		u, ok := tx.User(user.Id)
+		current, _ := tx.Password(user.Id)
+		if !ok || NormalizeEmail(u.Email) != NormalizeEmail(email) || !bytes.Equal(current, pw) {
+			return errors.New("user changed during login")
+		}
+		user = u
+		if tf, ok := tx.TwoFactor(u.Id); ok && tf.Enabled() {
+			return ErrTwoFactorRequired
+		}
+		return issueRefreshToken(tx, u.Id, refresh, ttl, client)
+	})
+	return user, err
 }
 
-func (db *DB) CreateUser(email string, password []byte) (User, error) {
-	pw, _ := bcrypt.GenerateFromPassword(password, 10)
-	newUser := User{Email: email, Id: -1, IsChirpyRed: false}
-	if dbStructure, err := db.loadDB(); err == nil {
-		for i := range dbStructure.Users {
-			if _, ok := dbStructure.Users[i]; !ok {
-				newUser.Id = i
-				break
-			}
+// issueRefreshToken stores refresh as the first token of a new family
+func issueRefreshToken(tx *Tx, userId int, refresh string, ttl time.Duration, client Client) error {
+	now := time.Now().UTC()
+	hash := HashToken(refresh)
+	return tx.PutRefreshToken(hash, RefreshToken{
+		UserId:    userId,
+		Family:    hash,
+		LoginAt:   now,
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	})
+}
+
+// UserRevoke logs out the session a refresh token belongs to,
+// revoking every token of its family
+func (db *DB) UserRevoke(refresh string) (bool, error) {
+	revoked := false
+	err := db.Update(func(tx *Tx) error {
+		rt, ok := tx.RefreshToken(HashToken(refresh))
+		if !ok {
+			return nil
 		}
-		if newUser.Id == -1 {
-			newUser.Id = len(dbStructure.Users) + 1
+		revoked = true
+		return revokeFamily(tx, rt.Family)
+	})
+	return revoked && err == nil, err
+}
+
+// fileBackend stores the database as a JSON snapshot at path and an
+// append-only write-ahead log at path+".wal". Compaction folds the log into
+// the snapshot and moves its records to path+".history", which together
+// with the log is the full history used for point-in-time restores.
+// It holds an advisory lock on path+".lock" so only one process writes
+type fileBackend struct {
+	path    string
+	keys    *EncryptionKeys
+	lock    *os.File
+	wal     *os.File
+	walSize int
+}
+
+// openFileBackend takes the lock for path and creates the database file
+// if it doesn't exist
+func openFileBackend(path string, keys *EncryptionKeys) (*fileBackend, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	fb := &fileBackend{path: path, keys: keys, lock: lock}
+	if err := fb.ensureDB(); err != nil {
+		fb.close()
+		return nil, err
+	}
+	wal, err := os.OpenFile(fb.walPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		fb.close()
+		return nil, err
+	}
+	fb.wal = wal
+	return fb, nil
+}
+
+func (fb *fileBackend) walPath() string {
+	return fb.path + ".wal"
+}
+
+func (fb *fileBackend) historyPath() string {
+	return fb.path + ".history"
+}
+
+// ensureDB creates a new database file if it doesn't exist
+func (fb *fileBackend) ensureDB() error {
+	f, err := os.OpenFile(fb.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// load reads the snapshot and replays the log records written after it,
+// truncating a record torn by a crash from the end of the log
+func (fb *fileBackend) load() (map[string]any, int64, error) {
+	state, seq, size, pending, err := readFileState(fb.path, fb.wal, fb.keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := fb.wal.Truncate(size); err != nil {
+		return nil, 0, err
+	}
+	fb.walSize = pending
+	return state, seq, fb.ensureHistory(state, seq)
+}
+
+// readFileState replays the snapshot at path and the log read from wal.
+// It returns the seq of the last record, the length of the valid part of
+// the log and the number of records not yet folded into the snapshot
+func readFileState(path string, wal io.Reader, keys *EncryptionKeys) (state map[string]any, seq int64, size int64, pending int, err error) {
+	sealed, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, 0, 0, err
+	}
+	snapshot, err := keys.open(sealed)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	var meta struct {
+		LogSeq int64 `json:"log_seq"`
+	}
+	if len(snapshot) > 0 {
+		if err := json.Unmarshal(snapshot, &meta); err != nil {
+			return nil, 0, 0, 0, err
 		}
-		dbStructure.Users[newUser.Id] = newUser
-		dbStructure.Passwords[newUser.Id] = pw
-		werr := db.writeDB(dbStructure)
-		return newUser, werr
 	}
+	records, size, err := readLog(wal, keys)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	// records already folded into the snapshot by a compaction
+	// that crashed before emptying the log
+	unfolded := []logRecord{}
+	for _, rec := range records {
+		if rec.Seq > meta.LogSeq {
+			unfolded = append(unfolded, rec)
+		}
+	}
+	state, err = replay(snapshot, unfolded)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return state, max(meta.LogSeq, lastSeq(unfolded)), size, len(unfolded), nil
+}
+
+// ensureHistory starts the history with a snapshot of state, so databases
+// created before the log existed can still be restored
+func (fb *fileBackend) ensureHistory(state map[string]any, seq int64) error {
+	if _, err := os.Stat(fb.historyPath()); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	j, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	line, err := encodeRecord(logRecord{Seq: seq, Time: time.Now().UTC(), Snapshot: j}, fb.keys)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fb.historyPath(), line)
+}
 
-	return newUser, nil
+func (fb *fileBackend) append(rec logRecord) error {
+	line, err := encodeRecord(rec, fb.keys)
+	if err != nil {
+		return err
+	}
+	if _, err := fb.wal.Write(line); err != nil {
+		return err
+	}
+	if err := fb.wal.Sync(); err != nil {
+		return err
+	}
+	fb.walSize++
+	return nil
 }
 
-func (db *DB) UserLogin(email string, password []byte, refresh string) (User, error) {
-	if dbStructure, err := db.loadDB(); err == nil {
-		for i := range dbStructure.Users {
-			if user, ok := dbStructure.Users[i]; ok {
-				if user.Email == email {
-					pw := dbStructure.Passwords[i]
-					err := bcrypt.CompareHashAndPassword(pw, password)
-					if err != nil {
-						return user, err
-					} else {
-						dbStructure.RefreshTokens[refresh] = user.Id
-						db.writeDB(dbStructure)
-						return user, nil
-					}
-				}
+func (fb *fileBackend) logSize() int {
+	return fb.walSize
+}
+
+// compact writes data as the new snapshot, then moves the log to the
+// history. A crash in between leaves records in the log that the snapshot
+// already contains, load skips them by seq
+func (fb *fileBackend) compact(data DBStructure) error {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	sealed, err := fb.keys.seal(j)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fb.path, sealed); err != nil {
+		return err
+	}
+	if fb.walSize == 0 {
+		return nil
+	}
+	records, err := os.ReadFile(fb.walPath())
+	if err != nil {
+		return err
+	}
+	history, err := os.OpenFile(fb.historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := history.Write(records); err != nil {
+		history.Close()
+		return err
+	}
+	if err := history.Sync(); err != nil {
+		history.Close()
+		return err
+	}
+	if err := history.Close(); err != nil {
+		return err
+	}
+	if err := fb.wal.Truncate(0); err != nil {
+		return err
+	}
+	fb.walSize = 0
+	return fb.wal.Sync()
+}
+
+// history returns every record in the history and the log, in seq order
+func (fb *fileBackend) history() ([]logRecord, error) {
+	records := []logRecord{}
+	for _, path := range []string{fb.historyPath(), fb.walPath()} {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		recs, _, err := readLog(f, fb.keys)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range recs {
+			// a crash during compaction can copy records to the history twice
+			if rec.Seq > lastSeq(records) || len(records) == 0 {
+				records = append(records, rec)
 			}
 		}
 	}
-	return User{}, errors.New("db error")
+	return records, nil
 }
 
-func (db *DB) UserFromRefresh(refresh string) (User, error) {
-	if dbStructure, err := db.loadDB(); err == nil {
-		if val, ok := dbStructure.RefreshTokens[refresh]; ok {
-			if user, userHasToken := dbStructure.Users[val]; userHasToken {
-				return user, nil
-			}
+// reencrypt compacts, which seals the snapshot with the newest key and moves
+// the log to the history, then rewrites every history record the same way
+func (fb *fileBackend) reencrypt(data DBStructure) error {
+	if err := fb.compact(data); err != nil {
+		return err
+	}
+	records, err := fb.history()
+	if err != nil {
+		return err
+	}
+	return fb.rewriteHistory(records)
+}
+
+// rewriteHistory replaces the history with records, sealed with the newest
+// key. The log must have been compacted into the history first
+func (fb *fileBackend) rewriteHistory(records []logRecord) error {
+	history := []byte{}
+	for _, rec := range records {
+		line, err := encodeRecord(rec, fb.keys)
+		if err != nil {
+			return err
 		}
+		history = append(history, line...)
 	}
-	return User{}, errors.New("unauthorized")
+	return writeFileAtomic(fb.historyPath(), history)
 }
 
-func (db *DB) UserRevoke(refresh string) (bool, error) {
-	var err error
-	if dbStructure, err := db.loadDB(); err == nil {
-		_, ok := dbStructure.RefreshTokens[refresh]
-		delete(dbStructure.RefreshTokens, refresh)
+func (fb *fileBackend) close() error {
+	if fb.wal != nil {
+		fb.wal.Close()
+	}
+	return unlockFile(fb.lock)
+}
 
-		db.writeDB(dbStructure)
-		return ok, nil
+// writeFileAtomic writes data to a temporary file next to path, syncs it
+// and renames it over path, so readers only ever see a complete file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
 	}
-	return false, err
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// the files hold password hashes and secrets, only the owner may read them
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	f, err := os.OpenFile(db.path, os.O_RDWR, 0755)
+// syncDir flushes a directory so a rename inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		_, cerr := os.Create(db.path)
-		if cerr != nil {
-			panic("couldnt create file")
-		}
-		return nil
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
 	}
-	f.Close()
-	return err
+	return nil
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	bytes, err := os.ReadFile(db.path)
-	chirpsDb := DBStructure{
+func emptyDB() DBStructure {
+	return DBStructure{
+		Version:       schemaVersion(),
 		Chirps:        make(map[int]Chirp),
 		Users:         make(map[int]User),
 		Passwords:     make(map[int][]byte),
-		RefreshTokens: make(map[string]int),
-	}
-	if err == nil {
-		var uerr error
-		if len(bytes) > 0 {
-			uerr = json.Unmarshal(bytes, &chirpsDb)
-		}
-		return chirpsDb, uerr
+		RefreshTokens: make(map[string]RefreshToken),
+		AccessTokens:  make(map[string]AccessToken),
+		TwoFactor:     make(map[int]TwoFactor),
+		Sequences:     make(map[string]int),
 	}
-	return chirpsDb, err
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	j, err := json.Marshal(dbStructure)
-	if err != nil {
-		panic("json error")
+// decodeDB parses an encoded database, an empty input is an empty database
+func decodeDB(bytes []byte) (DBStructure, error) {
+	chirpsDb := emptyDB()
+	if len(bytes) == 0 {
+		return chirpsDb, nil
 	}
-	werr := os.WriteFile(db.path, j, 0666)
-	return werr
+	err := json.Unmarshal(bytes, &chirpsDb)
+	return chirpsDb, err
 }
@@ -1,18 +1,35 @@
 package internal
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestLoadDB(t *testing.T) {
-	db, err := NewDB("./testdata/database.json")
+// testStores returns a fresh instance of every Store backend
+func testStores(t *testing.T) map[string]*DB {
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
 	if err != nil {
 		t.Fatalf("no db %s", err)
 	}
-	params := struct {
-		AuthorId int
-		Sort     string
-	}{AuthorId: 0, Sort: ""}
+	t.Cleanup(func() { db.Close() })
+	return map[string]*DB{"file": db, "memory": NewMemoryDB()}
+}
+
+func TestLoadDB(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testLoadDB(t, db)
+		})
+	}
+}
+
+func testLoadDB(t *testing.T, db Store) {
+	params := ChirpsParams{AuthorId: 0, Sort: ""}
 	chirps, cerr := db.GetChirps(params)
 	if cerr != nil {
 		t.Fatalf("error loading chirps %s", cerr)
@@ -23,20 +40,21 @@ func TestLoadDB(t *testing.T) {
 }
 
 func TestCreateChirp(t *testing.T) {
-	db, err := NewDB("./testdata/database.json")
-	if err != nil {
-		t.Fatalf("no db %s", err)
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testCreateChirp(t, db)
+		})
 	}
+}
+
+func testCreateChirp(t *testing.T, db Store) {
 	body := "test chirp body afwef"
 	user := User{Id: 1}
 	_, cerr := db.CreateChirp(body, user)
 	if cerr != nil {
 		t.Fatalf("couldnt create chirp: '%s'", body)
 	}
-	params := struct {
-		AuthorId int
-		Sort     string
-	}{AuthorId: 0, Sort: ""}
+	params := ChirpsParams{AuthorId: 0, Sort: ""}
 	chirps, gerr := db.GetChirps(params)
 	if gerr != nil {
 		t.Fatalf("couldnt get chirps %s", gerr)
@@ -57,3 +75,225 @@ func TestCreateChirp(t *testing.T) {
 		t.Fatalf("expected len: %d actual length: %d", 2, len(chirps2))
 	}
 }
+
+func TestUserLogin(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("a@example.com", []byte("hunter2"))
+			if err != nil {
+				t.Fatalf("couldnt create user %s", err)
+			}
+			if _, err := db.UserLogin("a@example.com", []byte("wrong"), "refresh", time.Hour, Client{}); err == nil {
+				t.Fatalf("expected login with a wrong password to fail")
+			}
+			if _, err := db.UserLogin("a@example.com", []byte("hunter2"), "refresh", time.Hour, Client{}); err != nil {
+				t.Fatalf("couldnt login %s", err)
+			}
+			refreshed, rerr := db.RotateRefreshToken("refresh", "next", time.Hour, Client{})
+			if rerr != nil || refreshed.Id != user.Id {
+				t.Fatalf("expected user %d from refresh, got %v %v", user.Id, refreshed, rerr)
+			}
+			if revoked, _ := db.UserRevoke("next"); !revoked {
+				t.Fatalf("expected refresh token to be revoked")
+			}
+			if _, err := db.RotateRefreshToken("next", "again", time.Hour, Client{}); err == nil {
+				t.Fatalf("expected revoked refresh token to fail")
+			}
+		})
+	}
+}
+
+func TestConcurrentCreateChirp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := db.CreateChirp(fmt.Sprintf("chirp %d", i), User{Id: 1}); err != nil {
+				t.Errorf("couldnt create chirp %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	db.Close()
+
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	chirps, _ := reopened.GetChirps(ChirpsParams{})
+	if len(chirps) != 50 {
+		t.Fatalf("expected len: %d actual length: %d", 50, len(chirps))
+	}
+}
+
+func TestDBLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	if _, err := NewDB(path); err == nil {
+		t.Fatalf("expected a second writer on %s to be refused", path)
+	}
+	db.Close()
+	again, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db after close %s", err)
+	}
+	again.Close()
+}
+
+func TestDBFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	db.CreateUser("a@example.com", []byte("pw"))
+	if err := db.Compact(); err != nil {
+		t.Fatalf("couldnt compact %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("couldnt stat %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected mode 0600, got %o", mode)
+	}
+}
+
+func TestIdsAreNeverReused(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, _ := db.CreateUser("a@example.com", []byte("hunter2"))
+			first, _ := db.CreateChirp("first", user)
+			second, _ := db.CreateChirp("second", user)
+			if err := db.DeleteChirp(second.Id, user, 0); err != nil {
+				t.Fatalf("couldnt delete chirp %d", second.Id)
+			}
+			third, _ := db.CreateChirp("third", user)
+			if third.Id <= second.Id {
+				t.Fatalf("expected id after %d, got %d", second.Id, third.Id)
+			}
+			if chirp, _ := db.GetChirp(first.Id); chirp.Body != "first" {
+				t.Fatalf("chirp %d was overwritten: %v", first.Id, chirp)
+			}
+		})
+	}
+}
+
+func TestRestoresKeepIdsUnique(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, _ := db.CreateUser("a@example.com", []byte("hunter2"))
+			db.CreateChirp("first", user)
+			if _, err := db.CreateSnapshot("before"); err != nil {
+				t.Fatalf("couldnt snapshot %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			mark := time.Now()
+			time.Sleep(10 * time.Millisecond)
+			second, _ := db.CreateChirp("second", user)
+
+			if err := db.RestoreTo(mark); err != nil {
+				t.Fatalf("couldnt restore %s", err)
+			}
+			third, _ := db.CreateChirp("third", user)
+			if third.Id <= second.Id {
+				t.Fatalf("restore to a time reused id %d", third.Id)
+			}
+			if _, err := db.RestoreSnapshot("before"); err != nil {
+				t.Fatalf("couldnt restore snapshot %s", err)
+			}
+			fourth, _ := db.CreateChirp("fourth", user)
+			if fourth.Id <= third.Id {
+				t.Fatalf("restoring a snapshot reused id %d", fourth.Id)
+			}
+		})
+	}
+}
+
+func TestDeleteAndRestoreChirp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	chirp, _ := db.CreateChirp("oops", User{Id: 1})
+	if err := db.DeleteChirp(chirp.Id, User{Id: 2}, 0); err != ErrForbidden {
+		t.Fatalf("deleted another user's chirp")
+	}
+	if err := db.DeleteChirp(chirp.Id, User{Id: 1}, 0); err != nil {
+		t.Fatalf("couldnt delete chirp %d", chirp.Id)
+	}
+	db.Close()
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	defer db.Close()
+	if _, err := db.GetChirp(chirp.Id); err == nil {
+		t.Fatalf("deleted chirp is still visible")
+	}
+	if chirps, _ := db.GetChirps(ChirpsParams{}); len(chirps) != 0 {
+		t.Fatalf("expected no chirps, got %v", chirps)
+	}
+	if _, err := db.RestoreChirp(chirp.Id, 2, time.Hour); err != ErrForbidden {
+		t.Fatalf("expected %s, got %v", ErrForbidden, err)
+	}
+	if _, err := db.RestoreChirp(chirp.Id, 1, 0); err != ErrWindowExpired {
+		t.Fatalf("expected %s, got %v", ErrWindowExpired, err)
+	}
+	if _, err := db.RestoreChirp(chirp.Id, 1, time.Hour); err != nil {
+		t.Fatalf("couldnt restore chirp %s", err)
+	}
+	if _, err := db.GetChirp(chirp.Id); err != nil {
+		t.Fatalf("restored chirp is not visible %s", err)
+	}
+
+	db.DeleteChirp(chirp.Id, User{Id: 1}, 0)
+	if n, _ := db.PurgeDeletedChirps(time.Hour); n != 0 {
+		t.Fatalf("purged a chirp inside the retention period")
+	}
+	if n, _ := db.PurgeDeletedChirps(0); n != 1 {
+		t.Fatalf("expected 1 purged chirp, got %d", n)
+	}
+	if _, err := db.RestoreChirp(chirp.Id, 1, time.Hour); err != ErrNotFound {
+		t.Fatalf("expected purged chirp to be gone, got %v", err)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	db := NewMemoryDB()
+	user, _ := db.CreateUser("a@example.com", []byte("pw"))
+	if user.CreatedAt.IsZero() || !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Fatalf("new user timestamps wrong %v", user)
+	}
+	db.UpgradeUserRed(user.Id, true)
+	if upgraded, _ := db.GetUser(user.Id); !upgraded.UpdatedAt.After(user.UpdatedAt) || !upgraded.CreatedAt.Equal(user.CreatedAt) {
+		t.Fatalf("upgrade didnt bump updated_at %v", upgraded)
+	}
+
+	// ids and creation order disagree after a restore or an import
+	db.Update(func(tx *Tx) error {
+		now := time.Now().UTC()
+		tx.PutChirp(Chirp{Id: 1, AuthorId: user.Id, Body: "newer", CreatedAt: now})
+		tx.PutChirp(Chirp{Id: 2, AuthorId: user.Id, Body: "older", CreatedAt: now.Add(-time.Hour)})
+		return nil
+	})
+	chirps, _ := db.GetChirps(ChirpsParams{Sort: "created_at"})
+	if len(chirps) != 2 || chirps[0].Body != "older" {
+		t.Fatalf("expected oldest first, got %v", chirps)
+	}
+}
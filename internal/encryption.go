@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix starts every encrypted snapshot and log line, followed
+// by "<key id>:<base64 nonce+ciphertext>". Anything else is plaintext JSON
+const encryptedPrefix = "chirpy-enc-v1:"
+
+var errNoKeys = errors.New("database is encrypted but no encryption key is configured")
+
+// errDecrypt is returned for well formed data none of the keys can open,
+// usually because the wrong keys are configured
+var errDecrypt = errors.New("cannot decrypt the database, check the encryption keys")
+
+// EncryptionKeys are the AES-256-GCM keys used to encrypt the database
+// at rest. Data is encrypted with the newest key and decrypted with
+// whichever key it names, so older keys can be kept around for rotation
+type EncryptionKeys struct {
+	keys []encryptionKey
+}
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewEncryptionKey returns a random key in the form ParseEncryptionKeys reads
+func NewEncryptionKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseEncryptionKeys reads "id:base64key" entries separated by commas or
+// newlines, oldest first. The last entry is used to encrypt
+func ParseEncryptionKeys(spec string) (*EncryptionKeys, error) {
+	k := &EncryptionKeys{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("encryption key %q is not in the form id:base64key", entry)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("encryption key %s must be 32 bytes, got %d", id, len(raw))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, encryptionKey{id, aead})
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	return k, nil
+}
+
+// LoadEncryptionKeys reads the keys from spec or, when spec is empty, from
+// the file at path. It returns nil when neither is set
+func LoadEncryptionKeys(spec string, path string) (*EncryptionKeys, error) {
+	if spec == "" && path == "" {
+		return nil, nil
+	}
+	if spec == "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(b)
+	}
+	return ParseEncryptionKeys(spec)
+}
+
+// seal encrypts plain with the newest key, a nil EncryptionKeys leaves it as is
+func (k *EncryptionKeys) seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	key := k.keys[len(k.keys)-1]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plain, []byte(key.id))
+	out := []byte(encryptedPrefix + key.id + ":")
+	return base64.StdEncoding.AppendEncode(out, sealed), nil
+}
+
+// open decrypts data sealed with any of the keys, plaintext is returned as is
+func (k *EncryptionKeys) open(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte(encryptedPrefix)) {
+		return data, nil
+	}
+	id, encoded, ok := bytes.Cut(data[len(encryptedPrefix):], []byte(":"))
+	if !ok {
+		return nil, errors.New("malformed encrypted data")
+	}
+	if k == nil {
+		return nil, errNoKeys
+	}
+	for _, key := range k.keys {
+		if key.id != string(id) {
+			continue
+		}
+		sealed, err := base64.StdEncoding.AppendDecode(nil, encoded)
+		if err != nil {
+			return nil, err
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return nil, errors.New("malformed encrypted data")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, id)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errDecrypt, err)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w: no encryption key with id %q", errDecrypt, id)
+}
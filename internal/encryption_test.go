@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T, spec string) *EncryptionKeys {
+	keys, err := ParseEncryptionKeys(spec)
+	if err != nil {
+		t.Fatalf("couldnt parse keys %s", err)
+	}
+	return keys
+}
+
+func assertNoPlaintext(t *testing.T, path string, secret string) {
+	for _, suffix := range []string{"", ".wal", ".history"} {
+		b, _ := os.ReadFile(path + suffix)
+		if bytes.Contains(b, []byte(secret)) {
+			t.Fatalf("%s contains %q in plaintext", path+suffix, secret)
+		}
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	oldKey, _ := NewEncryptionKey()
+	newKey, _ := NewEncryptionKey()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	db.CreateUser("secret@example.com", []byte("pw"))
+	db.Close()
+
+	db, err = OpenDB(path, Options{EncryptionKeys: testKeys(t, "old:"+oldKey)})
+	if err != nil {
+		t.Fatalf("couldnt open plaintext db with keys %s", err)
+	}
+	if err := db.Reencrypt(); err != nil {
+		t.Fatalf("couldnt reencrypt %s", err)
+	}
+	db.CreateChirp("also secret", User{Id: 1})
+	db.backend.close()
+	assertNoPlaintext(t, path, "secret")
+
+	if _, err := NewDB(path); err == nil {
+		t.Fatalf("opened an encrypted db without keys")
+	}
+
+	// rotate: add the new key, reencrypt, then drop the old one
+	db, err = OpenDB(path, Options{EncryptionKeys: testKeys(t, "old:"+oldKey+",new:"+newKey)})
+	if err != nil {
+		t.Fatalf("couldnt open with both keys %s", err)
+	}
+	if err := db.Reencrypt(); err != nil {
+		t.Fatalf("couldnt reencrypt %s", err)
+	}
+	db.Close()
+
+	db, err = OpenDB(path, Options{EncryptionKeys: testKeys(t, "new:"+newKey)})
+	if err != nil {
+		t.Fatalf("couldnt open with the new key only %s", err)
+	}
+	defer db.Close()
+	if _, err := db.UserLogin("secret@example.com", []byte("pw"), "r", time.Hour, Client{}); err != nil {
+		t.Fatalf("couldnt login after rotation %s", err)
+	}
+	if chirps, _ := db.GetChirps(ChirpsParams{}); len(chirps) != 1 {
+		t.Fatalf("expected 1 chirp after rotation, got %v", chirps)
+	}
+	if _, err := db.backend.history(); err != nil {
+		t.Fatalf("couldnt read history with the new key only %s", err)
+	}
+}
+
+func TestOpenWithWrongKeyLosesNothing(t *testing.T) {
+	key, _ := NewEncryptionKey()
+	wrong, _ := NewEncryptionKey()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	db.Close()
+	// the snapshot stays in plaintext, only the log record is encrypted
+	db, err = OpenDB(path, Options{EncryptionKeys: testKeys(t, "k:"+key)})
+	if err != nil {
+		t.Fatalf("couldnt open with keys %s", err)
+	}
+	db.CreateChirp("last", User{Id: 1})
+	db.backend.close()
+
+	for _, spec := range []string{"k:" + wrong, "other:" + wrong} {
+		if db, err := OpenDB(path, Options{EncryptionKeys: testKeys(t, spec)}); err == nil {
+			db.Close()
+			t.Fatalf("opened the db with the wrong key %s", spec)
+		}
+	}
+	db, err = OpenDB(path, Options{EncryptionKeys: testKeys(t, "k:"+key)})
+	if err != nil {
+		t.Fatalf("couldnt reopen with the right key %s", err)
+	}
+	defer db.Close()
+	if chirps, _ := db.GetChirps(ChirpsParams{}); len(chirps) != 1 {
+		t.Fatalf("expected the last chirp to survive, got %v", chirps)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	for _, spec := range []string{"", "nokey", "short:c2hvcnQ=", "bad:!!!"} {
+		if _, err := ParseEncryptionKeys(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Problem categories reported by Check
+const (
+	ProblemIdMismatch         = "id-mismatch"
+	ProblemSequenceBehind     = "sequence-behind"
+	ProblemOrphanPassword     = "orphan-password"
+	ProblemMissingPassword    = "missing-password"
+	ProblemOrphanRefreshToken = "orphan-refresh-token"
+	ProblemOrphanAccessToken  = "orphan-access-token"
+	ProblemOrphanTwoFactor    = "orphan-two-factor"
+	ProblemOrphanChirp        = "orphan-chirp"
+	ProblemDuplicateEmail     = "duplicate-email"
+	ProblemUnreadable         = "unreadable"
+)
+
+// Problem is an inconsistency found by Check
+type Problem struct {
+	Category string `json:"category"`
+	Record   string `json:"record"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+}
+
+// finding is a problem and, when there is a safe one, its fix
+type finding struct {
+	Problem
+	fix func(tx *Tx) error
+}
+
+// Check scans the database for inconsistencies between its tables. With
+// repair every problem that has a safe fix is fixed, all in one transaction
+func (db *DB) Check(repair bool) ([]Problem, error) {
+	problems := []Problem{}
+	run := func(tx *Tx) error {
+		for _, f := range check(tx) {
+			if repair && f.fix != nil {
+				if err := f.fix(tx); err != nil {
+					return fmt.Errorf("repairing %s %s: %w", f.Category, f.Record, err)
+				}
+				f.Repaired = true
+			}
+			problems = append(problems, f.Problem)
+		}
+		return nil
+	}
+	var err error
+	if repair {
+		err = db.Update(run)
+	} else {
+		err = db.View(run)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Category != problems[j].Category {
+			return problems[i].Category < problems[j].Category
+		}
+		return problems[i].Record < problems[j].Record
+	})
+	return problems, nil
+}
+
+// CheckFile checks the database at path like Check without repairs, but
+// reads the file instead of opening it: nothing is migrated, compacted or
+// locked, and a file that fails to migrate or decode is reported as such
+func CheckFile(path string, opts Options) ([]Problem, error) {
+	state, err := readState(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrate(state); err != nil {
+		return []Problem{{Category: ProblemUnreadable, Record: path, Message: fmt.Sprintf("migrating: %s", err)}}, nil
+	}
+	data, err := decodeState(state)
+	if err != nil {
+		return []Problem{{Category: ProblemUnreadable, Record: path, Message: fmt.Sprintf("decoding: %s", err)}}, nil
+	}
+	db := &DB{path: path, mux: &sync.RWMutex{}, backend: &memoryBackend{}, data: data, index: buildIndexes(data)}
+	return db.Check(false)
+}
+
+func check(tx *Tx) []finding {
+	findings := []finding{}
+	report := func(category, record, message string, fix func(tx *Tx) error) {
+		findings = append(findings, finding{Problem{Category: category, Record: record, Message: message}, fix})
+	}
+
+	users := all(tx, "users", tx.db.data.Users, strconv.Atoi)
+	chirps := all(tx, "chirps", tx.db.data.Chirps, strconv.Atoi)
+	passwords := tx.Passwords()
+
+	for id, user := range users {
+		if user.Id != id {
+			report(ProblemIdMismatch, fmt.Sprintf("users/%d", id), fmt.Sprintf("stored under %d but has id %d", id, user.Id),
+				func(tx *Tx) error {
+					user, ok := tx.User(id)
+					if !ok {
+						return nil
+					}
+					user.Id = id
+					return tx.PutUser(user)
+				})
+		}
+		if _, ok := passwords[id]; !ok {
+			report(ProblemMissingPassword, fmt.Sprintf("users/%d", id), "user has no password and cannot log in", nil)
+		}
+	}
+	for id, chirp := range chirps {
+		if chirp.Id != id {
+			report(ProblemIdMismatch, fmt.Sprintf("chirps/%d", id), fmt.Sprintf("stored under %d but has id %d", id, chirp.Id),
+				func(tx *Tx) error {
+					chirp, ok := tx.Chirp(id)
+					if !ok {
+						return nil
+					}
+					chirp.Id = id
+					return tx.PutChirp(chirp)
+				})
+		}
+		if _, ok := users[chirp.AuthorId]; !ok && chirp.DeletedAt == nil {
+			report(ProblemOrphanChirp, fmt.Sprintf("chirps/%d", id), fmt.Sprintf("author %d does not exist, repair deletes the chirp", chirp.AuthorId),
+				func(tx *Tx) error {
+					chirp, ok := tx.Chirp(id)
+					if !ok {
+						return nil
+					}
+					now := time.Now().UTC()
+					chirp.Id = id
+					chirp.DeletedAt = &now
+					return tx.PutChirp(chirp)
+				})
+		}
+	}
+	for id := range passwords {
+		if _, ok := users[id]; !ok {
+			report(ProblemOrphanPassword, fmt.Sprintf("passwords/%d", id), fmt.Sprintf("user %d does not exist", id),
+				func(tx *Tx) error { return tx.DeletePassword(id) })
+		}
+	}
+	for hash, rt := range tx.RefreshTokens() {
+		if _, ok := users[rt.UserId]; !ok {
+			report(ProblemOrphanRefreshToken, "refresh_tokens/"+redact(hash), fmt.Sprintf("user %d does not exist", rt.UserId),
+				func(tx *Tx) error { return tx.DeleteRefreshToken(hash) })
+		}
+	}
+	for id, at := range tx.AccessTokens() {
+		if _, ok := users[at.UserId]; !ok {
+			report(ProblemOrphanAccessToken, "access_tokens/"+redact(id), fmt.Sprintf("user %d does not exist", at.UserId),
+				func(tx *Tx) error { return tx.DeleteAccessToken(id) })
+		}
+	}
+	for id := range tx.TwoFactors() {
+		if _, ok := users[id]; !ok {
+			report(ProblemOrphanTwoFactor, fmt.Sprintf("two_factor/%d", id), fmt.Sprintf("user %d does not exist", id),
+				func(tx *Tx) error { return tx.DeleteTwoFactor(id) })
+		}
+	}
+
+	for table, ids := range map[string][]int{"users": keysOf(users), "chirps": keysOf(chirps)} {
+		last := 0
+		for _, id := range ids {
+			last = max(last, id)
+		}
+		if seq := tx.Sequence(table); seq < last {
+			report(ProblemSequenceBehind, "sequences/"+table, fmt.Sprintf("sequence is at %d but id %d exists", seq, last),
+				func(tx *Tx) error { return tx.PutSequence(table, last) })
+		}
+	}
+
+	byEmail := map[string][]int{}
+	for id, user := range users {
+		email := NormalizeEmail(user.Email)
+		byEmail[email] = append(byEmail[email], id)
+	}
+	for email, ids := range byEmail {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			report(ProblemDuplicateEmail, fmt.Sprintf("users/%d", ids[0]), fmt.Sprintf("%s is shared by users %v, only %d can log in", email, ids, ids[0]), nil)
+		}
+	}
+	return findings
+}
+
+func keysOf[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// redact shortens a secret to a prefix that identifies it in reports
+func redact(secret string) string {
+	if len(secret) <= 8 {
+		return "…"
+	}
+	return secret[:8] + "…"
+}
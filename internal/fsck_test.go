@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	db := NewMemoryDB()
+	user, _ := db.CreateUser("a@example.com", []byte("pw"))
+	db.CreateChirp("hello", user)
+	if problems, err := db.Check(false); err != nil || len(problems) != 0 {
+		t.Fatalf("expected a clean database, got %v %v", problems, err)
+	}
+
+	// corrupt the tables behind the transactions' back
+	db.Update(func(tx *Tx) error {
+		tx.PutPassword(9, []byte("hash"))
+		tx.PutRefreshToken("abcdefghijkl", RefreshToken{UserId: 9, ExpiresAt: time.Now().Add(time.Hour)})
+		tx.PutChirp(Chirp{Id: 7, AuthorId: 9, Body: "orphan"})
+		tx.PutUser(User{Id: 2, Email: "A@example.com"})
+		return nil
+	})
+	problems, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("check failed %s", err)
+	}
+	found := map[string]int{}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Fatalf("check without repair repaired %v", p)
+		}
+		found[p.Category]++
+	}
+	for _, category := range []string{ProblemOrphanPassword, ProblemOrphanRefreshToken, ProblemOrphanChirp, ProblemMissingPassword, ProblemDuplicateEmail} {
+		if found[category] != 1 {
+			t.Fatalf("expected one %s, got %v", category, problems)
+		}
+	}
+	if found[ProblemSequenceBehind] != 2 {
+		t.Fatalf("expected both sequences behind, got %v", problems)
+	}
+
+	if _, err := db.Check(true); err != nil {
+		t.Fatalf("repair failed %s", err)
+	}
+	problems, _ = db.Check(false)
+	for _, p := range problems {
+		if p.Category != ProblemMissingPassword && p.Category != ProblemDuplicateEmail {
+			t.Fatalf("problem survived repair %v", p)
+		}
+	}
+	if _, err := db.GetChirp(7); err != ErrNotFound {
+		t.Fatalf("orphan chirp was not deleted")
+	}
+	if chirp, _ := db.CreateChirp("next", user); chirp.Id != 8 {
+		t.Fatalf("expected the repaired sequence to hand out 8, got %d", chirp.Id)
+	}
+}
+
+func TestRepairRecordWithTwoProblems(t *testing.T) {
+	db := NewMemoryDB()
+	db.Update(func(tx *Tx) error {
+		// stored under 3 with the wrong id and no author
+		return tx.put("chirps", 3, Chirp{Id: 4, AuthorId: 9, Body: "orphan", Version: 1})
+	})
+	problems, err := db.Check(true)
+	if err != nil {
+		t.Fatalf("repair failed %s", err)
+	}
+	repaired := 0
+	for _, p := range problems {
+		if p.Record == "chirps/3" && p.Repaired {
+			repaired++
+		}
+	}
+	if repaired != 2 {
+		t.Fatalf("expected both problems of chirps/3 repaired, got %v", problems)
+	}
+	db.View(func(tx *Tx) error {
+		if chirp, _ := tx.Chirp(3); chirp.Id != 3 || chirp.DeletedAt == nil {
+			t.Fatalf("expected chirp 3 fixed and deleted, got %v", chirp)
+		}
+		return nil
+	})
+}
+
+func TestCheckFileIsReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	old := `{"chirps":{"1":{"id":1,"body":"old","author_id":1}},"users":{},"passwords":{},"refresh_tokens":{}}`
+	os.WriteFile(path, []byte(old), 0600)
+
+	problems, err := CheckFile(path, Options{})
+	if err != nil {
+		t.Fatalf("check failed %s", err)
+	}
+	if len(problems) == 0 || problems[0].Category != ProblemOrphanChirp {
+		t.Fatalf("expected the orphan chirp, got %v", problems)
+	}
+	if b, _ := os.ReadFile(path); string(b) != old {
+		t.Fatalf("check changed the database: %s", b)
+	}
+	for _, p := range []string{path + ".wal", path + ".history", path + ".lock"} {
+		if _, err := os.Stat(p); err == nil {
+			t.Fatalf("check created %s", p)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"version":999}`), 0600)
+	problems, err = CheckFile(path, Options{})
+	if err != nil || len(problems) != 1 || problems[0].Category != ProblemUnreadable {
+		t.Fatalf("expected the newer schema reported, got %v %v", problems, err)
+	}
+}
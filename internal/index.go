@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexes are derived from DBStructure. They are never persisted, but
+// rebuilt on load and kept up to date by DB.apply on every change
+type indexes struct {
+	chirpsByAuthor map[int]map[int]struct{}
+	userByEmail    map[string]int
+}
+
+// NormalizeEmail returns the form of an email address used to look users up
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func buildIndexes(data DBStructure) indexes {
+	ix := indexes{
+		chirpsByAuthor: make(map[int]map[int]struct{}),
+		userByEmail:    make(map[string]int),
+	}
+	for _, chirp := range data.Chirps {
+		ix.addChirp(chirp)
+	}
+	// the oldest account keeps an email address shared by several users
+	ids := make([]int, 0, len(data.Users))
+	for id := range data.Users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		ix.addUser(data.Users[id])
+	}
+	return ix
+}
+
+func (ix *indexes) addChirp(chirp Chirp) {
+	ids, ok := ix.chirpsByAuthor[chirp.AuthorId]
+	if !ok {
+		ids = make(map[int]struct{})
+		ix.chirpsByAuthor[chirp.AuthorId] = ids
+	}
+	ids[chirp.Id] = struct{}{}
+}
+
+func (ix *indexes) removeChirp(chirp Chirp) {
+	ids := ix.chirpsByAuthor[chirp.AuthorId]
+	delete(ids, chirp.Id)
+	if len(ids) == 0 {
+		delete(ix.chirpsByAuthor, chirp.AuthorId)
+	}
+}
+
+func (ix *indexes) addUser(user User) {
+	email := NormalizeEmail(user.Email)
+	if _, taken := ix.userByEmail[email]; !taken {
+		ix.userByEmail[email] = user.Id
+	}
+}
+
+func (ix *indexes) removeUser(user User) {
+	email := NormalizeEmail(user.Email)
+	if ix.userByEmail[email] == user.Id {
+		delete(ix.userByEmail, email)
+	}
+}
+
+// apply performs o on the in-memory database and its indexes
+func (db *DB) apply(o op) error {
+	switch o.Table {
+	case "chirps":
+		id, err := strconv.Atoi(o.Key)
+		if err != nil {
+			return err
+		}
+		if old, ok := db.data.Chirps[id]; ok {
+			db.index.removeChirp(old)
+		}
+		err = db.data.apply(o)
+		if chirp, ok := db.data.Chirps[id]; ok {
+			db.index.addChirp(chirp)
+		}
+		return err
+	case "users":
+		id, err := strconv.Atoi(o.Key)
+		if err != nil {
+			return err
+		}
+		if old, ok := db.data.Users[id]; ok {
+			db.index.removeUser(old)
+		}
+		err = db.data.apply(o)
+		if user, ok := db.data.Users[id]; ok {
+			db.index.addUser(user)
+		}
+		return err
+	}
+	return db.data.apply(o)
+}
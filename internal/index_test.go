@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	alice, _ := db.CreateUser("Alice@example.com", []byte("pw"))
+	bob, _ := db.CreateUser("bob@example.com", []byte("pw"))
+	if _, err := db.CreateUser("ALICE@example.com ", []byte("pw")); err != ErrEmailTaken {
+		t.Fatalf("expected %s, got %v", ErrEmailTaken, err)
+	}
+	db.CreateChirp("a1", alice)
+	db.CreateChirp("b1", bob)
+	a2, _ := db.CreateChirp("a2", alice)
+	db.DeleteChirp(a2.Id, alice, 0)
+
+	if _, err := db.UpdateUser(bob.Id, "robert@example.com", []byte("pw"), 0); err != nil {
+		t.Fatalf("couldnt update user %s", err)
+	}
+	if _, err := db.UserLogin("bob@example.com", []byte("pw"), "r1", time.Hour, Client{}); err == nil {
+		t.Fatalf("logged in with an email that was changed")
+	}
+	db.Close()
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	defer db.Close()
+	if user, err := db.UserLogin("alice@EXAMPLE.com", []byte("pw"), "r2", time.Hour, Client{}); err != nil || user.Id != alice.Id {
+		t.Fatalf("expected login as %d, got %v %v", alice.Id, user, err)
+	}
+	if user, err := db.UserLogin("robert@example.com", []byte("pw"), "r3", time.Hour, Client{}); err != nil || user.Id != bob.Id {
+		t.Fatalf("expected login as %d, got %v %v", bob.Id, user, err)
+	}
+	chirps, _ := db.GetChirps(ChirpsParams{AuthorId: alice.Id})
+	if len(chirps) != 1 || chirps[0].Body != "a1" {
+		t.Fatalf("expected only a1, got %v", chirps)
+	}
+	db.RestoreChirp(a2.Id, alice.Id, time.Hour)
+	if chirps, _ := db.GetChirps(ChirpsParams{AuthorId: alice.Id, Sort: "desc"}); len(chirps) != 2 || chirps[0].Id != a2.Id {
+		t.Fatalf("expected a2 then a1, got %v", chirps)
+	}
+}
@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key states, from the file name of a key in the keys directory:
+// <kid>.pending.pem, <kid>.pem and <kid>.retired.pem
+const (
+	// KeyPending keys are published in the JWKS but don't sign yet,
+	// so verifiers can fetch them before the first token shows up
+	KeyPending = "pending"
+	// KeyActive keys validate tokens, the newest one signs
+	KeyActive = "active"
+	// KeyRetired keys are kept on disk but no longer trusted
+	KeyRetired = "retired"
+)
+
+// MinSecretLength is the shortest HMAC secret accepted, 256 bits for HS256
+const MinSecretLength = 32
+
+var ErrUnknownKey = errors.New("token signed with an unknown or retired key")
+
+// SigningKey is one key of a Keyring
+type SigningKey struct {
+	Id     string
+	State  string
+	Method jwt.SigningMethod
+	// private signs, public validates. Both are the secret for HMAC keys
+	private any
+	public  any
+}
+
+// Keyring holds the keys access tokens are signed and validated with:
+// HS256 secrets and the RS256/EdDSA keys of a keys directory.
+// Rotating a key without invalidating tokens in flight takes three steps:
+// add the new key as pending, activate it once verifiers have picked it up
+// from the JWKS, and retire the old key once its last token has expired.
+// Secrets have no pending state, verifiers of HS256 tokens are us
+type Keyring struct {
+	dir     string
+	secrets []*SigningKey
+	mux     sync.RWMutex
+	keys    []*SigningKey
+}
+
+// NewKeyring returns a keyring of the HS256 secrets in spec,
+// see ParseSecrets
+func NewKeyring(spec string) (*Keyring, error) {
+	secrets, err := ParseSecrets(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{secrets: secrets}, nil
+}
+
+// LoadKeyring reads the keys in dir along with the secrets in spec, which
+// may be empty. Secrets validate tokens issued before the keys directory
+// was set up and only sign while it has no active key
+func LoadKeyring(dir string, spec string) (*Keyring, error) {
+	k := &Keyring{dir: dir}
+	if spec != "" {
+		secrets, err := ParseSecrets(spec)
+		if err != nil {
+			return nil, err
+		}
+		k.secrets = secrets
+	}
+	return k, k.Reload()
+}
+
+// ParseSecrets reads HS256 secrets separated by commas or newlines, oldest
+// first, each "kid:secret" or "kid:secret:retired". A secret without a kid
+// validates tokens without a kid header, as issued before secrets had kids,
+// and is retired by removing it. The newest active secret signs
+func ParseSecrets(spec string) ([]*SigningKey, error) {
+	secrets := []*SigningKey{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			id, secret = "", entry
+		}
+		state := KeyActive
+		if s, ok := strings.CutSuffix(secret, ":"+KeyRetired); ok {
+			secret, state = s, KeyRetired
+		}
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("jwt secret %q must be at least %d bytes, got %d", id, MinSecretLength, len(secret))
+		}
+		key := hmacKey(id, []byte(secret))
+		key.State = state
+		secrets = append(secrets, key)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no jwt secret")
+	}
+	return secrets, nil
+}
+
+func hmacKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{Id: id, State: KeyActive, Method: jwt.SigningMethodHS256, private: secret, public: secret}
+}
+
+// Reload reads the keys directory again, picking up rotations
+func (k *Keyring) Reload() error {
+	if k.dir == "" {
+		return nil
+	}
+	keys, err := readKeyDir(k.dir)
+	if err != nil {
+		return err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.keys = keys
+	return nil
+}
+
+func readKeyDir(dir string) ([]*SigningKey, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*SigningKey{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".pem")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, state := name, KeyActive
+		if kid, ok := strings.CutSuffix(name, "."+KeyPending); ok {
+			id, state = kid, KeyPending
+		} else if kid, ok := strings.CutSuffix(name, "."+KeyRetired); ok {
+			id, state = kid, KeyRetired
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePrivateKey(id, b)
+		if err != nil {
+			return nil, err
+		}
+		key.State = state
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	return keys, nil
+}
+
+func parsePrivateKey(id string, b []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM", id)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{Id: id, Method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{Id: id, Method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported key type %T", id, private)
+}
+
+// GenerateKey writes a new RS256 or EdDSA key to dir and returns its kid,
+// kids sort in the order keys were generated
+func GenerateKey(dir string, alg string, state string) (string, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q, use RS256 or EdDSA", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	id := fmt.Sprintf("%s-%09d", now.Format("20060102T150405Z"), now.Nanosecond())
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyPath(dir, id, state), pemBytes, 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SetKeyState moves a key in dir to another state
+func SetKeyState(dir string, id string, state string) error {
+	for _, from := range []string{KeyPending, KeyActive, KeyRetired} {
+		path := keyPath(dir, id, from)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		return os.Rename(path, keyPath(dir, id, state))
+	}
+	return fmt.Errorf("no key %s in %s", id, dir)
+}
+
+func keyPath(dir string, id string, state string) string {
+	if state == KeyActive {
+		return filepath.Join(dir, id+".pem")
+	}
+	return filepath.Join(dir, id+"."+state+".pem")
+}
+
+// Keys returns every key of the keyring, oldest first
+func (k *Keyring) Keys() []SigningKey {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	keys := []SigningKey{}
+	for _, key := range k.secrets {
+		keys = append(keys, *key)
+	}
+	for _, key := range k.keys {
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+// signingKey is the newest active key, or secret when there is none
+func (k *Keyring) signingKey() (*SigningKey, error) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	for _, keys := range [][]*SigningKey{k.keys, k.secrets} {
+		for i := len(keys) - 1; i >= 0; i-- {
+			if keys[i].State == KeyActive {
+				return keys[i], nil
+			}
+		}
+	}
+	return nil, errors.New("no active signing key")
+}
+
+// Sign signs claims with the newest active key, naming it in the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.Id != "" {
+		token.Header["kid"] = key.Id
+	}
+	return token.SignedString(key.private)
+}
+
+// Keyfunc finds the active key a token names in its kid header, for
+// jwt.Parse. Tokens without a kid are validated by the secret without one
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	id, _ := token.Header["kid"].(string)
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	var key *SigningKey
+	for _, candidate := range append(append([]*SigningKey{}, k.secrets...), k.keys...) {
+		if candidate.Id == id && candidate.State == KeyActive {
+			key = candidate
+		}
+	}
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("token is signed with %s but key %s is %s", token.Method.Alg(), id, key.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// JWK is the public half of a signing key as published in the JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the JSON Web Key Set served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the pending and active asymmetric keys
+func (k *Keyring) JWKS() JWKS {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if key.State == KeyRetired {
+			continue
+		}
+		jwk := JWK{Kid: key.Id, Alg: key.Method.Alg(), Use: "sig"}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
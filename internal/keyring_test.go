@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	old, err := GenerateKey(dir, "RS256", KeyActive)
+	if err != nil {
+		t.Fatalf("couldnt generate key %s", err)
+	}
+	keys, err := LoadKeyring(dir, "")
+	if err != nil {
+		t.Fatalf("couldnt load keys %s", err)
+	}
+	user := &User{Id: 1}
+	oldToken, _ := CreateJwt(user, keys, 0)
+
+	next, _ := GenerateKey(dir, "EdDSA", KeyPending)
+	keys.Reload()
+	if len(keys.JWKS().Keys) != 2 {
+		t.Fatalf("expected the pending key to be published, got %v", keys.JWKS())
+	}
+	if token, _ := CreateJwt(user, keys, 0); kid(t, keys, token) != old {
+		t.Fatalf("pending key signed a token")
+	}
+
+	SetKeyState(dir, next, KeyActive)
+	keys.Reload()
+	newToken, _ := CreateJwt(user, keys, 0)
+	if kid(t, keys, newToken) != next {
+		t.Fatalf("expected the newest active key to sign")
+	}
+	if kid(t, keys, oldToken) != old {
+		t.Fatalf("old key stopped validating before it was retired")
+	}
+
+	SetKeyState(dir, old, KeyRetired)
+	keys.Reload()
+	if _, err := ValidateToken(oldToken, keys, &MyCustomClaims{}); err == nil {
+		t.Fatalf("retired key still validates")
+	}
+	if jwks := keys.JWKS(); len(jwks.Keys) != 1 || jwks.Keys[0].Kid != next || jwks.Keys[0].Crv != "Ed25519" {
+		t.Fatalf("expected only %s in the jwks, got %v", next, jwks)
+	}
+}
+
+const legacySecret = "0123456789abcdef0123456789abcdef"
+
+func TestKeyAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := GenerateKey(dir, "RS256", KeyActive)
+	keys, _ := LoadKeyring(dir, legacySecret)
+	public := keys.JWKS().Keys[0].N
+
+	// an HS256 token keyed with the published RSA modulus must not pass
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	forged.Header["kid"] = id
+	ss, _ := forged.SignedString([]byte(public))
+	if _, err := ValidateToken(ss, keys, &MyCustomClaims{}); err == nil {
+		t.Fatalf("accepted an HS256 token naming an RSA key")
+	}
+
+	legacyKeys, _ := NewKeyring(legacySecret)
+	legacy, _ := legacyKeys.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if _, err := ValidateToken(legacy, keys, &MyCustomClaims{}); err != nil {
+		t.Fatalf("token signed with the secret before the switch was refused %s", err)
+	}
+}
+
+// kid validates token and returns the key id it was signed with
+func kid(t *testing.T, keys *Keyring, token string) string {
+	parsed, err := ValidateToken(token, keys, &MyCustomClaims{})
+	if err != nil {
+		t.Fatalf("token didnt validate %s", err)
+	}
+	id, _ := parsed.Header["kid"].(string)
+	return id
+}
+
+func TestSecretRotation(t *testing.T) {
+	user := &User{Id: 1}
+	before, _ := NewKeyring(legacySecret)
+	legacyToken, _ := CreateJwt(user, before, 0)
+
+	// a new secret is added without logging anyone out
+	rotated, err := NewKeyring(legacySecret + ",2026:fedcba9876543210fedcba9876543210")
+	if err != nil {
+		t.Fatalf("couldnt parse secrets %s", err)
+	}
+	newToken, _ := CreateJwt(user, rotated, 0)
+	if kid(t, rotated, newToken) != "2026" {
+		t.Fatalf("expected the newest secret to sign")
+	}
+	if kid(t, rotated, legacyToken) != "" {
+		t.Fatalf("expected the old secret to validate")
+	}
+
+	retired, err := NewKeyring("2026:fedcba9876543210fedcba9876543210:retired,2027:" + legacySecret)
+	if err != nil {
+		t.Fatalf("couldnt parse secrets %s", err)
+	}
+	if _, err := ValidateToken(newToken, retired, &MyCustomClaims{}); err == nil {
+		t.Fatalf("retired secret still validates")
+	}
+	if _, err := ValidateToken(legacyToken, retired, &MyCustomClaims{}); err == nil {
+		t.Fatalf("removed secret still validates")
+	}
+}
+
+func TestRefuseWeakSecrets(t *testing.T) {
+	for _, spec := range []string{"", " , ", "short", "k1:" + legacySecret + ",k2:short"} {
+		if _, err := NewKeyring(spec); err == nil {
+			t.Fatalf("accepted jwt secret %q", spec)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// lockFile only creates path, advisory locks are not supported here
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+}
+
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
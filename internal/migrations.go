@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration upgrades the generic JSON form of the database
+// from schema version Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(state map[string]any) error
+	// Scrub, when set, takes the secret the migration removes out of the
+	// history written before it, see scrubHistory
+	Scrub *Scrub
+}
+
+// Scrub rewrites the snapshots and ops written before a migration that
+// removes a secret from the database, so the history, which keeps every
+// old record, doesn't keep the secret too
+type Scrub struct {
+	// Marker is set in scrubbed snapshots, so they are never scrubbed
+	// twice. Up must expect it and remove it
+	Marker string
+	State  func(state map[string]any)
+	Op     func(o op) op
+}
+
+// refreshTokensHashed marks snapshots whose refresh tokens were
+// hashed by scrubbing the history, see migration 6
+const refreshTokensHashed = "refresh_tokens_hashed"
+
+// migrations are run in order on every database older than their version.
+// Append new migrations to the end, never change one that has shipped
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "add schema version",
+		Up:          func(state map[string]any) error { return nil },
+	},
+	{
+		Version:     2,
+		Description: "add id sequences starting after the highest existing id",
+		Up: func(state map[string]any) error {
+			sequences := map[string]any{}
+			for _, table := range []string{"chirps", "users"} {
+				records, _ := state[table].(map[string]any)
+				last := 0
+				for key := range records {
+					id, err := strconv.Atoi(key)
+					if err != nil {
+						return fmt.Errorf("%s has a non numeric id %q", table, key)
+					}
+					last = max(last, id)
+				}
+				sequences[table] = float64(last)
+			}
+			state["sequences"] = sequences
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "add created_at and updated_at to chirps and users, backfilled with the migration time",
+		Up: func(state map[string]any) error {
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			for _, table := range []string{"chirps", "users"} {
+				records, _ := state[table].(map[string]any)
+				for key, v := range records {
+					record, ok := v.(map[string]any)
+					if !ok {
+						return fmt.Errorf("%s/%s is not an object", table, key)
+					}
+					if _, ok := record["created_at"]; !ok {
+						record["created_at"] = now
+					}
+					if _, ok := record["updated_at"]; !ok {
+						record["updated_at"] = record["created_at"]
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "add a version counter to chirps and users, starting at 1",
+		Up: func(state map[string]any) error {
+			for _, table := range []string{"chirps", "users"} {
+				records, _ := state[table].(map[string]any)
+				for key, v := range records {
+					record, ok := v.(map[string]any)
+					if !ok {
+						return fmt.Errorf("%s/%s is not an object", table, key)
+					}
+					if _, ok := record["version"]; !ok {
+						record["version"] = float64(1)
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "store refresh tokens with issued_at and expires_at, existing tokens expire 60 days after the migration",
+		Up: func(state map[string]any) error {
+			now := time.Now().UTC()
+			tokens, _ := state["refresh_tokens"].(map[string]any)
+			for token, v := range tokens {
+				if _, ok := v.(map[string]any); ok {
+					continue
+				}
+				userId, ok := v.(float64)
+				if !ok {
+					return fmt.Errorf("refresh token %s has no user id", redact(token))
+				}
+				tokens[token] = map[string]any{
+					"user_id":    userId,
+					"issued_at":  now.Format(time.RFC3339Nano),
+					"expires_at": now.Add(60 * 24 * time.Hour).Format(time.RFC3339Nano),
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "store refresh tokens by hash, each token starts its own family",
+		Up: func(state map[string]any) error {
+			_, scrubbed := state[refreshTokensHashed]
+			delete(state, refreshTokensHashed)
+			tokens, _ := state["refresh_tokens"].(map[string]any)
+			hashed := map[string]any{}
+			for token, v := range tokens {
+				rt, ok := v.(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh token %s is not an object", redact(token))
+				}
+				hash := token
+				if !scrubbed {
+					hash = HashToken(token)
+				}
+				rt["family"] = hash
+				hashed[hash] = rt
+			}
+			state["refresh_tokens"] = hashed
+			return nil
+		},
+		Scrub: &Scrub{
+			Marker: refreshTokensHashed,
+			State: func(state map[string]any) {
+				tokens, _ := state["refresh_tokens"].(map[string]any)
+				hashed := map[string]any{}
+				for token, v := range tokens {
+					hashed[HashToken(token)] = v
+				}
+				state["refresh_tokens"] = hashed
+				state[refreshTokensHashed] = true
+			},
+			Op: func(o op) op {
+				if o.Table == "refresh_tokens" {
+					o.Key = HashToken(o.Key)
+				}
+				return o
+			},
+		},
+	},
+	{
+		Version:     7,
+		Description: "add login_at to refresh tokens, existing sessions start at their token's issued_at",
+		Up: func(state map[string]any) error {
+			tokens, _ := state["refresh_tokens"].(map[string]any)
+			for hash, v := range tokens {
+				rt, ok := v.(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh token %s is not an object", redact(hash))
+				}
+				if _, ok := rt["login_at"]; !ok {
+					rt["login_at"] = rt["issued_at"]
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "add personal access tokens",
+		Up: func(state map[string]any) error {
+			if _, ok := state["access_tokens"]; !ok {
+				state["access_tokens"] = map[string]any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "add two-factor authentication",
+		Up: func(state map[string]any) error {
+			if _, ok := state["two_factor"]; !ok {
+				state["two_factor"] = map[string]any{}
+			}
+			return nil
+		},
+	},
+}
+
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// stateVersion reads the schema version of the generic JSON form of a
+// database, files written before versioning are version 0
+func stateVersion(state map[string]any) int {
+	if v, ok := state["version"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// migrate runs every pending migration on state in place
+// and returns the ones it ran
+func migrate(state map[string]any) ([]Migration, error) {
+	version := stateVersion(state)
+	if version > schemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this build (%d)", version, schemaVersion())
+	}
+	applied := []Migration{}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := m.Up(state); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		state["version"] = float64(m.Version)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrationChange describes what one pending migration would change
+type MigrationChange struct {
+	Version     int      `json:"version"`
+	Description string   `json:"description"`
+	Changed     []string `json:"changed"`
+}
+
+// readState reads the database at path and its write-ahead log without
+// taking the lock or writing anything
+func readState(path string, opts Options) (map[string]any, error) {
+	wal, err := os.Open(path + ".wal")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var log io.Reader = strings.NewReader("")
+	if wal != nil {
+		defer wal.Close()
+		log = wal
+	}
+	state, _, _, _, err := readFileState(path, log, opts.EncryptionKeys)
+	return state, err
+}
+
+// PlanMigrations reports the migrations opening the database at path would
+// run and the records each one would change, without writing anything
+func PlanMigrations(path string, opts Options) ([]MigrationChange, error) {
+	state, err := readState(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	version := stateVersion(state)
+	if version > schemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this build (%d)", version, schemaVersion())
+	}
+	changes := []MigrationChange{}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		before, err := cloneState(state)
+		if err != nil {
+			return changes, err
+		}
+		if err := m.Up(state); err != nil {
+			return changes, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		state["version"] = float64(m.Version)
+		changes = append(changes, MigrationChange{
+			Version:     m.Version,
+			Description: m.Description,
+			Changed:     diffState(before, state),
+		})
+	}
+	return changes, nil
+}
+
+func cloneState(state map[string]any) (map[string]any, error) {
+	j, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	clone := map[string]any{}
+	return clone, json.Unmarshal(j, &clone)
+}
+
+// diffState lists the top level fields and the "table/key" records
+// that differ between two generic JSON databases, ignoring the version
+func diffState(before, after map[string]any) []string {
+	changed := []string{}
+	for _, name := range unionKeys(before, after) {
+		if name == "version" {
+			continue
+		}
+		b, bok := before[name].(map[string]any)
+		a, aok := after[name].(map[string]any)
+		if !bok || !aok {
+			if !reflect.DeepEqual(before[name], after[name]) {
+				changed = append(changed, name)
+			}
+			continue
+		}
+		for _, key := range unionKeys(b, a) {
+			if !reflect.DeepEqual(b[key], a[key]) {
+				changed = append(changed, name+"/"+redactKey(name, key))
+			}
+		}
+	}
+	return changed
+}
+
+// secretTables are keyed by a token or, since they were hashed, by a
+// value that identifies it, their keys are never printed in full
+var secretTables = map[string]bool{"refresh_tokens": true, "access_tokens": true}
+
+func redactKey(table string, key string) string {
+	if secretTables[table] {
+		return redact(key)
+	}
+	return key
+}
+
+func unionKeys(a, b map[string]any) []string {
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scrubHistory applies the scrubs of the applied migrations to the records
+// of history written before them, that is to the snapshots older than the
+// migration and the ops that follow them. It reports whether it changed
+// anything. Snapshots carrying a scrub's marker were scrubbed already
+func scrubHistory(history []logRecord, applied []Migration) ([]logRecord, bool, error) {
+	scrubbed := make([]logRecord, 0, len(history))
+	changed := false
+	// pending are the scrubs that apply to the ops of the current snapshot
+	pending := []*Scrub{}
+	for _, rec := range history {
+		if rec.Snapshot != nil {
+			state := map[string]any{}
+			if err := json.Unmarshal(rec.Snapshot, &state); err != nil {
+				return nil, false, err
+			}
+			if pending = scrubState(state, applied); len(pending) > 0 {
+				j, err := json.Marshal(state)
+				if err != nil {
+					return nil, false, err
+				}
+				rec.Snapshot = j
+				changed = true
+			}
+		}
+		if len(pending) > 0 && len(rec.Ops) > 0 {
+			ops := make([]op, len(rec.Ops))
+			for i, o := range rec.Ops {
+				for _, scrub := range pending {
+					o = scrub.Op(o)
+				}
+				ops[i] = o
+			}
+			rec.Ops = ops
+			changed = true
+		}
+		scrubbed = append(scrubbed, rec)
+	}
+	return scrubbed, changed, nil
+}
+
+// scrubState applies the scrubs of the applied migrations newer than state
+// that it wasn't scrubbed with yet, and returns them
+func scrubState(state map[string]any, applied []Migration) []*Scrub {
+	version := stateVersion(state)
+	scrubs := []*Scrub{}
+	for _, m := range applied {
+		if m.Scrub == nil || version >= m.Version {
+			continue
+		}
+		if _, ok := state[m.Scrub.Marker]; ok {
+			continue
+		}
+		m.Scrub.State(state)
+		scrubs = append(scrubs, m.Scrub)
+	}
+	return scrubs
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateUnversionedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	old := `{"chirps":{"1":{"id":1,"body":"old","author_id":1}},"users":{},"passwords":{},"refresh_tokens":{}}`
+	os.WriteFile(path, []byte(old), 0666)
+
+	changes, err := PlanMigrations(path, Options{})
+	if err != nil {
+		t.Fatalf("couldnt plan migrations %s", err)
+	}
+	if len(changes) != len(migrations) {
+		t.Fatalf("expected %d pending migrations, got %v", len(migrations), changes)
+	}
+	if b, _ := os.ReadFile(path); string(b) != old {
+		t.Fatalf("dry run changed the database: %s", b)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	if chirp, err := db.GetChirp(1); err != nil || chirp.Body != "old" {
+		t.Fatalf("expected the old chirp to survive migration, got %v %v", chirp, err)
+	}
+	db.Close()
+
+	var meta struct {
+		Version int `json:"version"`
+	}
+	b, _ := os.ReadFile(path)
+	json.Unmarshal(b, &meta)
+	if meta.Version != schemaVersion() {
+		t.Fatalf("expected version: %d actual: %d", schemaVersion(), meta.Version)
+	}
+	if changes, _ := PlanMigrations(path, Options{}); len(changes) != 0 {
+		t.Fatalf("expected no pending migrations, got %v", changes)
+	}
+}
+
+func TestMigrationChanges(t *testing.T) {
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(append([]Migration{}, saved...), Migration{
+		Version:     schemaVersion() + 1,
+		Description: "shout chirps",
+		Up: func(state map[string]any) error {
+			chirps, _ := state["chirps"].(map[string]any)
+			for _, c := range chirps {
+				chirp := c.(map[string]any)
+				chirp["body"] = chirp["body"].(string) + "!"
+			}
+			return nil
+		},
+	})
+
+	path := filepath.Join(t.TempDir(), "database.json")
+	current := fmt.Sprintf(`{"version":%d,"chirps":{"1":{"id":1,"body":"hi","author_id":1}}}`, saved[len(saved)-1].Version)
+	os.WriteFile(path, []byte(current), 0666)
+	changes, err := PlanMigrations(path, Options{})
+	if err != nil {
+		t.Fatalf("couldnt plan migrations %s", err)
+	}
+	if len(changes) != 1 || len(changes[0].Changed) != 1 || changes[0].Changed[0] != "chirps/1" {
+		t.Fatalf("expected chirps/1 to change, got %v", changes)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	if chirp, _ := db.GetChirp(1); chirp.Body != "hi!" {
+		t.Fatalf("expected migrated body, got %q", chirp.Body)
+	}
+}
+
+func TestMigrationChangesRedactTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	os.WriteFile(path, []byte(`{"version":4,"refresh_tokens":{"a-raw-refresh-token":1}}`), 0666)
+	changes, err := PlanMigrations(path, Options{})
+	if err != nil {
+		t.Fatalf("couldnt plan migrations %s", err)
+	}
+	for _, c := range changes {
+		for _, record := range c.Changed {
+			if strings.Contains(record, "a-raw-refresh-token") || strings.Contains(record, HashToken("a-raw-refresh-token")) {
+				t.Fatalf("migration %d prints a token in full: %s", c.Version, record)
+			}
+		}
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	os.WriteFile(path, []byte(`{"version":9999}`), 0666)
+	if _, err := NewDB(path); err == nil {
+		t.Fatalf("expected a database from a newer build to be refused")
+	}
+}
+
+func TestMigrateSparseIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	os.WriteFile(path, []byte(`{"version":1,"chirps":{"1":{"id":1,"body":"a"},"5":{"id":5,"body":"b"}}}`), 0666)
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	chirp, _ := db.CreateChirp("c", User{Id: 1})
+	if chirp.Id != 6 {
+		t.Fatalf("expected id: %d actual: %d", 6, chirp.Id)
+	}
+	if old, _ := db.GetChirp(5); old.Body != "b" {
+		t.Fatalf("chirp 5 was overwritten: %v", old)
+	}
+}
+
+func TestMigrateBackfillsTimestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	os.WriteFile(path, []byte(`{"version":2,"chirps":{"1":{"id":1,"body":"a","author_id":1}},"users":{"1":{"id":1,"email":"a@example.com"}},"sequences":{"chirps":1,"users":1}}`), 0666)
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	chirp, _ := db.GetChirp(1)
+	user, _ := db.GetUser(1)
+	if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Fatalf("chirp timestamps not backfilled %v", chirp)
+	}
+	if user.CreatedAt.IsZero() || !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Fatalf("user timestamps not backfilled %v", user)
+	}
+}
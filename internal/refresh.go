@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrTokenExpired = errors.New("refresh token expired")
+	ErrTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+)
+
+// RefreshToken is a login session, stored under the hash of the token.
+// Every refresh rotates the token, the new one joins the family of the
+// login it descends from and the old one is kept as rotated until it
+// expires, so that replaying it can be caught
+type RefreshToken struct {
+	UserId int `json:"user_id"`
+	// Family is the hash of the token the login was issued with,
+	// it identifies the session
+	Family string `json:"family"`
+	// LoginAt is when the family's first token was issued
+	LoginAt    time.Time  `json:"login_at"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	IP         string     `json:"ip,omitempty"`
+	IssuedAt   time.Time  `json:"issued_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+}
+
+// HashToken returns the hash a refresh token is stored under
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Client describes where a refresh token is used from
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+// RotateRefreshToken exchanges refresh for next, valid for ttl, and returns
+// the user they belong to. Presenting a token that was already rotated
+// revokes its whole family and returns ErrTokenReused
+func (db *DB) RotateRefreshToken(refresh string, next string, ttl time.Duration, client Client) (User, error) {
+	var user User
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		hash := HashToken(refresh)
+		rt, ok := tx.RefreshToken(hash)
+		if !ok {
+			return errors.New("unauthorized")
+		}
+		if rt.RotatedAt != nil {
+			reused = true
+			return revokeFamily(tx, rt.Family)
+		}
+		now := time.Now().UTC()
+		if !now.Before(rt.ExpiresAt) {
+			return ErrTokenExpired
+		}
+		u, ok := tx.User(rt.UserId)
+		if !ok {
+			return errors.New("unauthorized")
+		}
+		user = u
+		rt.LastUsedAt = &now
+		rt.RotatedAt = &now
+		if err := tx.PutRefreshToken(hash, rt); err != nil {
+			return err
+		}
+		return tx.PutRefreshToken(HashToken(next), RefreshToken{
+			UserId:     rt.UserId,
+			Family:     rt.Family,
+			LoginAt:    rt.LoginAt,
+			UserAgent:  client.UserAgent,
+			IP:         client.IP,
+			IssuedAt:   now,
+			ExpiresAt:  now.Add(ttl),
+			LastUsedAt: &now,
+		})
+	})
+	if err == nil && reused {
+		return User{}, ErrTokenReused
+	}
+	return user, err
+}
+
+func revokeFamily(tx *Tx, family string) error {
+	for hash, rt := range tx.RefreshTokens() {
+		if rt.Family == family {
+			if err := tx.DeleteRefreshToken(hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredRefreshTokens removes every expired refresh token and
+// returns how many it removed
+func (db *DB) PurgeExpiredRefreshTokens() (int, error) {
+	purged := 0
+	err := db.Update(func(tx *Tx) error {
+		now := time.Now()
+		for hash, rt := range tx.RefreshTokens() {
+			if !now.Before(rt.ExpiresAt) {
+				if err := tx.DeleteRefreshToken(hash); err != nil {
+					return err
+				}
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	db := NewMemoryDB()
+	db.CreateUser("a@example.com", []byte("pw"))
+	db.UserLogin("a@example.com", []byte("pw"), "live", time.Hour, Client{})
+	db.UserLogin("a@example.com", []byte("pw"), "dead", 0, Client{})
+
+	if _, err := db.RotateRefreshToken("live", "live2", time.Hour, Client{}); err != nil {
+		t.Fatalf("live token refused %s", err)
+	}
+	db.View(func(tx *Tx) error {
+		if rt, _ := tx.RefreshToken(HashToken("live")); rt.LastUsedAt == nil || rt.IssuedAt.IsZero() {
+			t.Fatalf("expected issued_at and last_used_at, got %v", rt)
+		}
+		return nil
+	})
+	if _, err := db.RotateRefreshToken("dead", "dead2", time.Hour, Client{}); err != ErrTokenExpired {
+		t.Fatalf("expected %s, got %v", ErrTokenExpired, err)
+	}
+	if n, _ := db.PurgeExpiredRefreshTokens(); n != 1 {
+		t.Fatalf("expected 1 swept token, got %d", n)
+	}
+	if _, err := db.RotateRefreshToken("live2", "live3", time.Hour, Client{}); err != nil {
+		t.Fatalf("sweeper removed a live token %s", err)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	db := NewMemoryDB()
+	db.CreateUser("a@example.com", []byte("pw"))
+	db.UserLogin("a@example.com", []byte("pw"), "phone", time.Hour, Client{})
+	db.UserLogin("a@example.com", []byte("pw"), "laptop", time.Hour, Client{})
+	db.RotateRefreshToken("phone", "phone2", time.Hour, Client{})
+
+	// an attacker replays the stolen original after the owner refreshed
+	if _, err := db.RotateRefreshToken("phone", "stolen", time.Hour, Client{}); err != ErrTokenReused {
+		t.Fatalf("expected %s, got %v", ErrTokenReused, err)
+	}
+	if _, err := db.RotateRefreshToken("phone2", "phone3", time.Hour, Client{}); err == nil {
+		t.Fatalf("expected the reused token's family to be revoked")
+	}
+	if _, err := db.RotateRefreshToken("laptop", "laptop2", time.Hour, Client{}); err != nil {
+		t.Fatalf("reuse revoked another session %s", err)
+	}
+}
+
+func TestRefreshTokensAreHashed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	db.CreateUser("a@example.com", []byte("pw"))
+	db.UserLogin("a@example.com", []byte("pw"), "plaintext-token", time.Hour, Client{})
+	db.Close()
+	for _, suffix := range []string{"", ".wal", ".history"} {
+		if b, _ := os.ReadFile(path + suffix); strings.Contains(string(b), "plaintext-token") {
+			t.Fatalf("%s contains the refresh token", path+suffix)
+		}
+	}
+}
+
+func TestMigrateRefreshTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	os.WriteFile(path, []byte(`{"version":4,"users":{"1":{"id":1,"email":"a@example.com","version":1}},"refresh_tokens":{"old":1},"sequences":{"users":1}}`), 0666)
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	if user, err := db.RotateRefreshToken("old", "new", time.Hour, Client{}); err != nil || user.Id != 1 {
+		t.Fatalf("expected the old token to keep working, got %v %v", user, err)
+	}
+}
+
+func TestMigrationScrubsRawRefreshTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	const first, second = "raw-token-in-the-snapshot", "raw-token-in-an-op"
+	before := time.Now().UTC().Add(-time.Hour)
+	snapshot := `{"version":4,"users":{"1":{"id":1,"email":"a@example.com","version":1}},"refresh_tokens":{"` + first + `":1},"sequences":{"users":1}}`
+	history := []byte{}
+	for _, rec := range []logRecord{
+		{Seq: 0, Time: before, Snapshot: []byte(snapshot)},
+		{Seq: 1, Time: before, Ops: []op{putOp("refresh_tokens", second, 1)}},
+	} {
+		line, _ := encodeRecord(rec, nil)
+		history = append(history, line...)
+	}
+	os.WriteFile(path+".history", history, 0666)
+	os.WriteFile(path, []byte(strings.Replace(snapshot, `"sequences"`, `"log_seq":1,"sequences"`, 1)), 0666)
+	data := snapshot
+	snap := snapshotFile{SnapshotInfo: SnapshotInfo{Name: "old", Version: 4, Checksum: HashToken(data), Size: len(data)}, Data: []byte(data)}
+	j, _ := json.Marshal(snap)
+	os.MkdirAll(path+".snapshots", 0755)
+	os.WriteFile(filepath.Join(path+".snapshots", "old.json"), j, 0666)
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	records, _ := db.backend.history()
+	db.Close()
+	for _, file := range []string{path, path + ".wal", path + ".history", filepath.Join(path+".snapshots", "old.json")} {
+		b, _ := os.ReadFile(file)
+		if strings.Contains(string(b), "raw-token") {
+			t.Fatalf("%s still contains a raw refresh token", file)
+		}
+	}
+
+	// the scrubbed history still restores, without hashing twice
+	restored, err := stateAt(records[:2], time.Now())
+	if err != nil {
+		t.Fatalf("couldnt restore scrubbed history %s", err)
+	}
+	for _, token := range []string{first, second} {
+		if rt, ok := restored.RefreshTokens[HashToken(token)]; !ok || rt.Family != HashToken(token) {
+			t.Fatalf("expected %s under its hash, got %v", token, restored.RefreshTokens)
+		}
+	}
+	db, _ = NewDB(path)
+	defer db.Close()
+	if _, err := db.VerifySnapshot("old"); err != nil {
+		t.Fatalf("scrubbed snapshot doesnt verify %s", err)
+	}
+	if _, err := db.RestoreSnapshot("old"); err != nil {
+		t.Fatalf("couldnt restore scrubbed snapshot %s", err)
+	}
+	if _, err := db.RotateRefreshToken(first, "next", time.Hour, Client{}); err != nil {
+		t.Fatalf("token from the scrubbed snapshot doesnt work %s", err)
+	}
+}
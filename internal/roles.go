@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Roles a user can be granted, users without a role can only
+// act on their own chirps and account
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// Permissions checked by the routes that need more than a logged in user
+const (
+	PermReadMetrics     = "metrics:read"
+	PermResetMetrics    = "metrics:reset"
+	PermManageUsers     = "users:manage"
+	PermManageSnapshots = "snapshots:manage"
+	PermReadAudit       = "audit:read"
+	PermModerateChirp   = "chirps:moderate"
+)
+
+// rolePermissions is what each role may do, admins may do everything
+var rolePermissions = map[string][]string{
+	RoleAdmin:     {PermReadMetrics, PermResetMetrics, PermManageUsers, PermManageSnapshots, PermReadAudit, PermModerateChirp},
+	RoleModerator: {PermModerateChirp},
+}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// ValidateRoles returns roles sorted and without duplicates,
+// or ErrUnknownRole if one of them doesn't exist
+func ValidateRoles(roles []string) ([]string, error) {
+	seen := map[string]bool{}
+	valid := []string{}
+	for _, role := range roles {
+		if _, ok := rolePermissions[role]; !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownRole, role)
+		}
+		if !seen[role] {
+			seen[role] = true
+			valid = append(valid, role)
+		}
+	}
+	sort.Strings(valid)
+	return valid, nil
+}
+
+// HasRole reports whether the user was granted role
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether one of the user's roles grants permission
+func (u User) Can(permission string) bool {
+	for _, role := range u.Roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetUsers returns every user ordered by id
+func (db *DB) GetUsers() ([]User, error) {
+	var users []User
+	err := db.View(func(tx *Tx) error {
+		users = tx.Users()
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, err
+}
+
+// SetUserRoles replaces a user's roles. A non zero version must match
+// the user's or ErrVersionMismatch is returned
+func (db *DB) SetUserRoles(userId int, roles []string, version int) (User, error) {
+	roles, err := ValidateRoles(roles)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = db.Update(func(tx *Tx) error {
+		u, ok := tx.User(userId)
+		if !ok {
+			return ErrNotFound
+		}
+		if version != 0 && u.Version != version {
+			return ErrVersionMismatch
+		}
+		u.Roles = roles
+		u.UpdatedAt = time.Now().UTC()
+		if err := tx.PutUser(u); err != nil {
+			return err
+		}
+		user, _ = tx.User(userId)
+		return nil
+	})
+	return user, err
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRoles(t *testing.T) {
+	db := NewMemoryDB()
+	author, _ := db.CreateUser("author@example.com", []byte("pw"))
+	mod, _ := db.CreateUser("mod@example.com", []byte("pw"))
+	if _, err := db.SetUserRoles(mod.Id, []string{"superuser"}, 0); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("expected %s, got %v", ErrUnknownRole, err)
+	}
+	if _, err := db.SetUserRoles(mod.Id, []string{RoleModerator}, 7); err != ErrVersionMismatch {
+		t.Fatalf("expected %s, got %v", ErrVersionMismatch, err)
+	}
+	mod, err := db.SetUserRoles(mod.Id, []string{RoleModerator, RoleModerator}, mod.Version)
+	if err != nil || len(mod.Roles) != 1 || !mod.HasRole(RoleModerator) {
+		t.Fatalf("couldnt make a moderator %v %v", mod, err)
+	}
+	if !mod.Can(PermModerateChirp) || mod.Can(PermManageUsers) || author.Can(PermModerateChirp) {
+		t.Fatalf("wrong permissions for %v", mod.Roles)
+	}
+	if !(User{Roles: []string{RoleAdmin}}).Can(PermModerateChirp) {
+		t.Fatalf("admins should be able to moderate")
+	}
+
+	chirp, _ := db.CreateChirp("kerfuffle", author)
+	if err := db.DeleteChirp(chirp.Id, User{Id: 99}, 0); err != ErrForbidden {
+		t.Fatalf("expected %s, got %v", ErrForbidden, err)
+	}
+	if err := db.DeleteChirp(chirp.Id, mod, 0); err != nil {
+		t.Fatalf("moderator couldnt delete chirp %s", err)
+	}
+	// the author cannot undo a moderator's removal
+	if _, err := db.RestoreChirp(chirp.Id, author.Id, time.Hour); err != ErrForbidden {
+		t.Fatalf("expected %s, got %v", ErrForbidden, err)
+	}
+}
+
+func TestRolesClaim(t *testing.T) {
+	keys, _ := NewKeyring("test:0123456789abcdef0123456789abcdef")
+	token, err := CreateJwt(&User{Id: 1, Roles: []string{RoleAdmin}}, keys, 0)
+	if err != nil {
+		t.Fatalf("couldnt sign %s", err)
+	}
+	claims := MyCustomClaims{}
+	if _, err := ValidateToken(token, keys, &claims); err != nil || len(claims.Roles) != 1 || claims.Roles[0] != RoleAdmin {
+		t.Fatalf("expected the admin role in the claims, got %v %v", claims.Roles, err)
+	}
+}
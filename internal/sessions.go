@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"sort"
+	"time"
+)
+
+// Session is a login as seen by its user, the family of
+// refresh tokens descending from it
+type Session struct {
+	Id         string     `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	LoginAt    time.Time  `json:"login_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+// Sessions returns a user's live sessions, most recently used first
+func (db *DB) Sessions(userId int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		now := time.Now()
+		for _, rt := range tx.RefreshTokens() {
+			if rt.UserId != userId || rt.RotatedAt != nil || !now.Before(rt.ExpiresAt) {
+				continue
+			}
+			sessions = append(sessions, Session{
+				Id:         rt.Family,
+				UserAgent:  rt.UserAgent,
+				IP:         rt.IP,
+				LoginAt:    rt.LoginAt,
+				LastUsedAt: rt.LastUsedAt,
+				ExpiresAt:  rt.ExpiresAt,
+			})
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return lastActive(sessions[i]).After(lastActive(sessions[j]))
+	})
+	return sessions, err
+}
+
+func lastActive(s Session) time.Time {
+	if s.LastUsedAt != nil {
+		return *s.LastUsedAt
+	}
+	return s.LoginAt
+}
+
+// RevokeSession logs a user out of one of their sessions
+func (db *DB) RevokeSession(userId int, sessionId string) error {
+	return db.Update(func(tx *Tx) error {
+		for _, rt := range tx.RefreshTokens() {
+			if rt.Family == sessionId && rt.UserId == userId {
+				return revokeFamily(tx, sessionId)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// RevokeAllSessions logs a user out everywhere and returns
+// how many sessions it ended
+func (db *DB) RevokeAllSessions(userId int) (int, error) {
+	revoked := 0
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		revoked, err = revokeAllSessions(tx, userId)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// revokeAllSessions deletes every refresh token of a user and returns
+// how many sessions they belonged to
+func revokeAllSessions(tx *Tx, userId int) (int, error) {
+	families := map[string]struct{}{}
+	for hash, rt := range tx.RefreshTokens() {
+		if rt.UserId == userId {
+			if err := tx.DeleteRefreshToken(hash); err != nil {
+				return 0, err
+			}
+			families[rt.Family] = struct{}{}
+		}
+	}
+	return len(families), nil
+}
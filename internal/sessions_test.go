@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	db := NewMemoryDB()
+	alice, _ := db.CreateUser("alice@example.com", []byte("pw"))
+	bob, _ := db.CreateUser("bob@example.com", []byte("pw"))
+	db.UserLogin("alice@example.com", []byte("pw"), "phone", time.Hour, Client{UserAgent: "phone", IP: "10.0.0.1"})
+	db.UserLogin("alice@example.com", []byte("pw"), "laptop", time.Hour, Client{UserAgent: "laptop", IP: "10.0.0.2"})
+	db.UserLogin("bob@example.com", []byte("pw"), "bob", time.Hour, Client{})
+	db.RotateRefreshToken("phone", "phone2", time.Hour, Client{UserAgent: "phone", IP: "10.0.0.3"})
+
+	sessions, _ := db.Sessions(alice.Id)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", sessions)
+	}
+	phone := sessions[0]
+	if phone.UserAgent != "phone" || phone.IP != "10.0.0.3" || phone.LastUsedAt == nil {
+		t.Fatalf("expected the refreshed phone session first, got %v", phone)
+	}
+	if phone.Id != HashToken("phone") {
+		t.Fatalf("expected the session to keep its id across rotation, got %s", phone.Id)
+	}
+
+	bobs, _ := db.Sessions(bob.Id)
+	if err := db.RevokeSession(alice.Id, bobs[0].Id); err != ErrNotFound {
+		t.Fatalf("expected %s revoking another user's session, got %v", ErrNotFound, err)
+	}
+	if err := db.RevokeSession(alice.Id, phone.Id); err != nil {
+		t.Fatalf("couldnt revoke session %s", err)
+	}
+	if _, err := db.RotateRefreshToken("phone2", "phone3", time.Hour, Client{}); err == nil {
+		t.Fatalf("revoked session can still refresh")
+	}
+	if n, _ := db.RevokeAllSessions(alice.Id); n != 1 {
+		t.Fatalf("expected 1 session logged out, got %d", n)
+	}
+	if sessions, _ := db.Sessions(alice.Id); len(sessions) != 0 {
+		t.Fatalf("expected no sessions, got %v", sessions)
+	}
+	if sessions, _ := db.Sessions(bob.Id); len(sessions) != 1 {
+		t.Fatalf("logging out everywhere touched another user, got %v", sessions)
+	}
+}
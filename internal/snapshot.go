@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSnapshotExists  = errors.New("snapshot already exists")
+	ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+)
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// SnapshotInfo describes a named snapshot
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int       `json:"version"`
+	Checksum  string    `json:"sha256"`
+	Size      int       `json:"size"`
+}
+
+// snapshotFile is what a snapshot is stored as, Checksum covers Data
+type snapshotFile struct {
+	SnapshotInfo
+	Data json.RawMessage `json:"data"`
+}
+
+// CreateSnapshot saves a consistent copy of the database under name
+func (db *DB) CreateSnapshot(name string) (SnapshotInfo, error) {
+	if !snapshotName.MatchString(name) {
+		return SnapshotInfo{}, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	// the write lock keeps writers out while the copy is taken
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, err := db.backend.readSnapshot(name); err == nil {
+		return SnapshotInfo{}, ErrSnapshotExists
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return SnapshotInfo{}, err
+	}
+	data, err := json.Marshal(db.data)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	sum := sha256.Sum256(data)
+	snap := snapshotFile{
+		SnapshotInfo: SnapshotInfo{
+			Name:      name,
+			CreatedAt: time.Now().UTC(),
+			Version:   db.data.Version,
+			Checksum:  hex.EncodeToString(sum[:]),
+			Size:      len(data),
+		},
+		Data: data,
+	}
+	j, err := json.Marshal(snap)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return snap.SnapshotInfo, db.backend.writeSnapshot(name, j)
+}
+
+// ListSnapshots returns every snapshot, oldest first
+func (db *DB) ListSnapshots() ([]SnapshotInfo, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	names, err := db.backend.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	infos := []SnapshotInfo{}
+	for _, name := range names {
+		snap, err := db.loadSnapshot(name)
+		if err != nil {
+			infos = append(infos, SnapshotInfo{Name: name})
+			continue
+		}
+		infos = append(infos, snap.SnapshotInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos, nil
+}
+
+// VerifySnapshot checks a snapshot's checksum and that it decodes
+// into a database this build can open
+func (db *DB) VerifySnapshot(name string) (SnapshotInfo, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	snap, err := db.loadSnapshot(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if _, err := snap.decode(); err != nil {
+		return snap.SnapshotInfo, err
+	}
+	return snap.SnapshotInfo, nil
+}
+
+// RestoreSnapshot verifies a snapshot and replaces the database with it.
+// The restore is logged like any other change
+func (db *DB) RestoreSnapshot(name string) (SnapshotInfo, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	snap, err := db.loadSnapshot(name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	data, err := snap.decode()
+	if err != nil {
+		return snap.SnapshotInfo, err
+	}
+	return snap.SnapshotInfo, db.commitSnapshot(data)
+}
+
+func (db *DB) loadSnapshot(name string) (snapshotFile, error) {
+	snap := snapshotFile{}
+	if !snapshotName.MatchString(name) {
+		return snap, ErrNotFound
+	}
+	j, err := db.backend.readSnapshot(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, ErrNotFound
+	} else if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(j, &snap); err != nil {
+		return snap, fmt.Errorf("%w: %s", ErrSnapshotCorrupt, err)
+	}
+	return snap, nil
+}
+
+// decode checks the snapshot's checksum and upgrades
+// its data to the current schema
+func (snap snapshotFile) decode() (DBStructure, error) {
+	sum := sha256.Sum256(snap.Data)
+	if hex.EncodeToString(sum[:]) != snap.Checksum {
+		return emptyDB(), fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+	state := map[string]any{}
+	if err := json.Unmarshal(snap.Data, &state); err != nil {
+		return emptyDB(), fmt.Errorf("%w: %s", ErrSnapshotCorrupt, err)
+	}
+	if _, err := migrate(state); err != nil {
+		return emptyDB(), err
+	}
+	return decodeState(state)
+}
+
+// scrubSnapshots applies the scrubs of the applied migrations to the named
+// snapshots taken before them, updating their checksums
+func (db *DB) scrubSnapshots(applied []Migration) error {
+	names, err := db.backend.listSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		snap, err := db.loadSnapshot(name)
+		if err != nil {
+			return err
+		}
+		// a corrupt snapshot is left alone, a new checksum would hide it
+		sum := sha256.Sum256(snap.Data)
+		state := map[string]any{}
+		if hex.EncodeToString(sum[:]) != snap.Checksum || json.Unmarshal(snap.Data, &state) != nil {
+			log.Printf("not scrubbing corrupt snapshot %s", name)
+			continue
+		}
+		if len(scrubState(state, applied)) == 0 {
+			continue
+		}
+		if snap.Data, err = json.Marshal(state); err != nil {
+			return err
+		}
+		sum = sha256.Sum256(snap.Data)
+		snap.Checksum = hex.EncodeToString(sum[:])
+		snap.Size = len(snap.Data)
+		j, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		if err := db.backend.writeSnapshot(name, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fb *fileBackend) snapshotDir() string {
+	return fb.path + ".snapshots"
+}
+
+func (fb *fileBackend) writeSnapshot(name string, data []byte) error {
+	if err := os.MkdirAll(fb.snapshotDir(), 0755); err != nil {
+		return err
+	}
+	sealed, err := fb.keys.seal(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(fb.snapshotDir(), name+".json"), sealed)
+}
+
+func (fb *fileBackend) readSnapshot(name string) ([]byte, error) {
+	sealed, err := os.ReadFile(filepath.Join(fb.snapshotDir(), name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	return fb.keys.open(sealed)
+}
+
+func (fb *fileBackend) listSnapshots() ([]string, error) {
+	entries, err := os.ReadDir(fb.snapshotDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (m *memoryBackend) writeSnapshot(name string, data []byte) error {
+	if m.snapshots == nil {
+		m.snapshots = map[string][]byte{}
+	}
+	m.snapshots[name] = data
+	return nil
+}
+
+func (m *memoryBackend) readSnapshot(name string) ([]byte, error) {
+	if data, ok := m.snapshots[name]; ok {
+		return data, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memoryBackend) listSnapshots() ([]string, error) {
+	names := []string{}
+	for name := range m.snapshots {
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db.CreateChirp("kept", User{Id: 1})
+			if _, err := db.CreateSnapshot("../escape"); err == nil {
+				t.Fatalf("accepted a snapshot name with a path")
+			}
+			info, err := db.CreateSnapshot("before")
+			if err != nil {
+				t.Fatalf("couldnt create snapshot %s", err)
+			}
+			if _, err := db.CreateSnapshot("before"); err != ErrSnapshotExists {
+				t.Fatalf("expected %s, got %v", ErrSnapshotExists, err)
+			}
+			db.CreateChirp("lost", User{Id: 1})
+
+			infos, _ := db.ListSnapshots()
+			if len(infos) != 1 || infos[0].Checksum != info.Checksum {
+				t.Fatalf("expected snapshot %v, got %v", info, infos)
+			}
+			if _, err := db.VerifySnapshot("before"); err != nil {
+				t.Fatalf("couldnt verify snapshot %s", err)
+			}
+			if _, err := db.RestoreSnapshot("before"); err != nil {
+				t.Fatalf("couldnt restore snapshot %s", err)
+			}
+			chirps, _ := db.GetChirps(ChirpsParams{})
+			if len(chirps) != 1 || chirps[0].Body != "kept" {
+				t.Fatalf("expected only the chirp from the snapshot, got %v", chirps)
+			}
+			if _, err := db.RestoreSnapshot("missing"); err != ErrNotFound {
+				t.Fatalf("expected %s, got %v", ErrNotFound, err)
+			}
+		})
+	}
+}
+
+func TestVerifyCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	defer db.Close()
+	db.CreateChirp("original", User{Id: 1})
+	db.CreateSnapshot("snap")
+
+	file := filepath.Join(path+".snapshots", "snap.json")
+	b, _ := os.ReadFile(file)
+	os.WriteFile(file, bytes.Replace(b, []byte("original"), []byte("tampered"), 1), 0666)
+	if _, err := db.VerifySnapshot("snap"); err == nil {
+		t.Fatalf("expected a tampered snapshot to fail verification")
+	}
+	if _, err := db.RestoreSnapshot("snap"); err == nil {
+		t.Fatalf("restored a tampered snapshot")
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Store is the storage used by the chirpy handlers
+type Store interface {
+	CreateChirp(body string, author User) (Chirp, error)
+	GetChirp(chirpId int) (Chirp, error)
+	GetChirps(params ChirpsParams) ([]Chirp, error)
+	DeleteChirp(chirpId int, by User, version int) error
+	RestoreChirp(chirpId int, userId int, window time.Duration) (Chirp, error)
+	PurgeDeletedChirps(retention time.Duration) (int, error)
+	GetUser(userId int) (User, error)
+	GetUsers() ([]User, error)
+	CreateUser(email string, password []byte) (User, error)
+	UpdateUser(userId int, email string, password []byte, version int) (User, error)
+	UpgradeUserRed(userId int, red bool) bool
+	SetUserRoles(userId int, roles []string, version int) (User, error)
+	UserLogin(email string, password []byte, refresh string, ttl time.Duration, client Client) (User, error)
+	RotateRefreshToken(refresh string, next string, ttl time.Duration, client Client) (User, error)
+	UserRevoke(refresh string) (bool, error)
+	PurgeExpiredRefreshTokens() (int, error)
+	Sessions(userId int) ([]Session, error)
+	RevokeSession(userId int, sessionId string) error
+	RevokeAllSessions(userId int) (int, error)
+	CreateAccessToken(userId int, token string, name string, scopes []string, ttl time.Duration) (AccessToken, error)
+	AccessTokens(userId int) ([]AccessToken, error)
+	RevokeAccessToken(userId int, id string) error
+	UseAccessToken(token string) (User, AccessToken, error)
+	EnrollTwoFactor(userId int) (string, error)
+	ConfirmTwoFactor(userId int, code string) ([]string, error)
+	RegenerateRecoveryCodes(userId int, code string) ([]string, error)
+	DisableTwoFactor(userId int, code string) error
+	ResetTwoFactor(userId int) error
+	TwoFactorLogin(userId int, code string, refresh string, ttl time.Duration, client Client) (User, error)
+	CreateSnapshot(name string) (SnapshotInfo, error)
+	ListSnapshots() ([]SnapshotInfo, error)
+	VerifySnapshot(name string) (SnapshotInfo, error)
+	RestoreSnapshot(name string) (SnapshotInfo, error)
+}
+
+var _ Store = (*DB)(nil)
+
+// ChirpsParams filters and orders the result of GetChirps
+type ChirpsParams struct {
+	AuthorId int
+	Sort     string
+}
+
+// backend loads the generic JSON form of a database once and then durably
+// records every change made to it. load also returns the seq of the last
+// record it replayed
+type backend interface {
+	load() (map[string]any, int64, error)
+	append(rec logRecord) error
+	logSize() int
+	compact(data DBStructure) error
+	history() ([]logRecord, error)
+	rewriteHistory(records []logRecord) error
+	reencrypt(data DBStructure) error
+	writeSnapshot(name string, data []byte) error
+	readSnapshot(name string) ([]byte, error)
+	listSnapshots() ([]string, error)
+	close() error
+}
+
+// memoryBackend keeps its history in memory and never touches the disk.
+// Compacting drops the records before the previous snapshot, so the
+// history holds at most about twice compactEvery records
+type memoryBackend struct {
+	records []logRecord
+	// logged is the number of records appended since the last compaction
+	logged    int
+	snapshots map[string][]byte
+}
+
+func (m *memoryBackend) load() (map[string]any, int64, error) {
+	j, err := json.Marshal(emptyDB())
+	if err != nil {
+		return nil, 0, err
+	}
+	m.records = []logRecord{{Time: time.Now().UTC(), Snapshot: j}}
+	state := map[string]any{}
+	return state, 0, json.Unmarshal(j, &state)
+}
+
+func (m *memoryBackend) append(rec logRecord) error {
+	m.records = append(m.records, rec)
+	m.logged++
+	return nil
+}
+
+func (m *memoryBackend) logSize() int {
+	return m.logged
+}
+
+// compact appends a snapshot of data, unless the history already ends
+// with one, and forgets the records before the snapshot preceding it
+func (m *memoryBackend) compact(data DBStructure) error {
+	if last := len(m.records) - 1; last < 0 || m.records[last].Snapshot == nil {
+		j, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		m.records = append(m.records, logRecord{Seq: data.LogSeq, Time: time.Now().UTC(), Snapshot: j})
+	}
+	base := 0
+	for i := len(m.records) - 2; i >= 0; i-- {
+		if m.records[i].Snapshot != nil {
+			base = i
+			break
+		}
+	}
+	m.records = append([]logRecord{}, m.records[base:]...)
+	m.logged = 0
+	return nil
+}
+
+func (m *memoryBackend) history() ([]logRecord, error) {
+	return m.records, nil
+}
+
+func (m *memoryBackend) rewriteHistory(records []logRecord) error {
+	m.records = records
+	return nil
+}
+
+func (m *memoryBackend) reencrypt(data DBStructure) error {
+	return nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// twoFactorMaxAttempts wrong codes in a row lock two-factor
+	// verification for twoFactorLockout
+	twoFactorMaxAttempts = 5
+	twoFactorLockout     = 15 * time.Minute
+)
+
+var (
+	ErrTwoFactorRequired    = errors.New("two-factor code required")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not enrolled")
+	ErrInvalidCode          = errors.New("invalid two-factor code")
+	ErrTwoFactorLocked      = errors.New("too many invalid two-factor codes, try again later")
+)
+
+// TwoFactor is a user's TOTP enrollment, stored under their id.
+// It only guards logins once the user has proven they can generate
+// codes with it, see ConfirmTwoFactor
+type TwoFactor struct {
+	UserId     int        `json:"user_id"`
+	Secret     string     `json:"secret"`
+	EnrolledAt time.Time  `json:"enrolled_at"`
+	EnabledAt  *time.Time `json:"enabled_at,omitempty"`
+	// LastStep is the TOTP step of the last accepted code
+	LastStep int64 `json:"last_step"`
+	// RecoveryCodes are hashed like refresh tokens, each works once
+	RecoveryCodes  []string   `json:"recovery_codes"`
+	FailedAttempts int        `json:"failed_attempts"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+}
+
+// Enabled reports whether logins need a code
+func (tf TwoFactor) Enabled() bool {
+	return tf.EnabledAt != nil
+}
+
+// newRecoveryCodes returns random recovery codes like "abcde-fghij"
+// and the hashes they are stored as
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return HashToken(code)
+}
+
+// checkCode accepts a TOTP code or an unused recovery code for tf,
+// updating tf. The caller must store tf whatever the outcome, so failed
+// attempts count towards the lockout
+func checkCode(tf *TwoFactor, code string, now time.Time) error {
+	if tf.LockedUntil != nil && now.Before(*tf.LockedUntil) {
+		return ErrTwoFactorLocked
+	}
+	if step, ok := verifyTOTP(tf.Secret, code, now, tf.LastStep); ok {
+		tf.LastStep = step
+		tf.FailedAttempts = 0
+		tf.LockedUntil = nil
+		return nil
+	}
+	hash := hashRecoveryCode(code)
+	for i, h := range tf.RecoveryCodes {
+		if h == hash {
+			tf.RecoveryCodes = append(tf.RecoveryCodes[:i:i], tf.RecoveryCodes[i+1:]...)
+			tf.FailedAttempts = 0
+			tf.LockedUntil = nil
+			return nil
+		}
+	}
+	tf.FailedAttempts++
+	if tf.FailedAttempts >= twoFactorMaxAttempts {
+		until := now.Add(twoFactorLockout)
+		tf.LockedUntil = &until
+		tf.FailedAttempts = 0
+	}
+	return ErrInvalidCode
+}
+
+// verifyTwoFactor checks code against a user's enabled enrollment. Like
+// checkCode, tf is written even when the code is wrong, so the error is
+// returned after the transaction commits
+func (db *DB) verifyTwoFactor(userId int, code string, then func(tx *Tx, tf TwoFactor) error) error {
+	var cerr error
+	err := db.Update(func(tx *Tx) error {
+		tf, ok := tx.TwoFactor(userId)
+		if !ok || !tf.Enabled() {
+			return ErrTwoFactorNotEnrolled
+		}
+		if cerr = checkCode(&tf, code, time.Now().UTC()); cerr != nil {
+			return tx.PutTwoFactor(tf)
+		}
+		if err := tx.PutTwoFactor(tf); err != nil {
+			return err
+		}
+		return then(tx, tf)
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// EnrollTwoFactor starts a TOTP enrollment with a new secret, replacing
+// one that was never confirmed. Logins don't need a code until the user
+// confirms it with ConfirmTwoFactor
+func (db *DB) EnrollTwoFactor(userId int) (string, error) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.User(userId); !ok {
+			return ErrNotFound
+		}
+		if tf, ok := tx.TwoFactor(userId); ok && tf.Enabled() {
+			return ErrTwoFactorEnabled
+		}
+		return tx.PutTwoFactor(TwoFactor{UserId: userId, Secret: secret, EnrolledAt: time.Now().UTC(), RecoveryCodes: []string{}})
+	})
+	return secret, err
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the user sends
+// a code generated from their new secret, and returns their recovery codes.
+// Every session is revoked, sessions from before could belong to whoever
+// the user is locking out
+func (db *DB) ConfirmTwoFactor(userId int, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	var cerr error
+	err = db.Update(func(tx *Tx) error {
+		tf, ok := tx.TwoFactor(userId)
+		if !ok {
+			return ErrTwoFactorNotEnrolled
+		}
+		if tf.Enabled() {
+			return ErrTwoFactorEnabled
+		}
+		now := time.Now().UTC()
+		if cerr = checkCode(&tf, code, now); cerr == nil {
+			tf.EnabledAt = &now
+			tf.RecoveryCodes = hashes
+			if _, err := revokeAllSessions(tx, userId); err != nil {
+				return err
+			}
+		}
+		return tx.PutTwoFactor(tf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes, after
+// checking a code from their authenticator
+func (db *DB) RegenerateRecoveryCodes(userId int, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = db.verifyTwoFactor(userId, code, func(tx *Tx, tf TwoFactor) error {
+		tf.RecoveryCodes = hashes
+		return tx.PutTwoFactor(tf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns two-factor authentication off for a user
+// who can still produce a code
+func (db *DB) DisableTwoFactor(userId int, code string) error {
+	return db.verifyTwoFactor(userId, code, func(tx *Tx, tf TwoFactor) error {
+		return tx.DeleteTwoFactor(userId)
+	})
+}
+
+// ResetTwoFactor turns two-factor authentication off for a user who lost
+// their authenticator and recovery codes, for admins. Their sessions are
+// revoked too, in case the account was taken over
+func (db *DB) ResetTwoFactor(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.User(userId); !ok {
+			return ErrNotFound
+		}
+		if _, err := revokeAllSessions(tx, userId); err != nil {
+			return err
+		}
+		if _, ok := tx.TwoFactor(userId); !ok {
+			return nil
+		}
+		return tx.DeleteTwoFactor(userId)
+	})
+}
+
+// TwoFactorLogin is the second step of a login for users with two-factor
+// authentication: it checks code, a TOTP code or a recovery code, and
+// issues the refresh token like UserLogin
+func (db *DB) TwoFactorLogin(userId int, code string, refresh string, ttl time.Duration, client Client) (User, error) {
+	var user User
+	err := db.verifyTwoFactor(userId, code, func(tx *Tx, tf TwoFactor) error {
+		u, ok := tx.User(userId)
+		if !ok {
+			return ErrNotFound
+		}
+		user = u
+		return issueRefreshToken(tx, u.Id, refresh, ttl, client)
+	})
+	return user, err
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	secret := base32NoPadding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		if code, _ := TOTPCode(secret, totpStep(time.Unix(unix, 0))); code != want {
+			t.Fatalf("expected %s at %d, got %s", want, unix, code)
+		}
+	}
+	uri := TOTPURI("SECRET", "Chirpy", "a@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:a@example.com?") || !strings.Contains(uri, "secret=SECRET") {
+		t.Fatalf("unexpected otpauth uri %s", uri)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	db := NewMemoryDB()
+	user, _ := db.CreateUser("a@example.com", []byte("pw"))
+	secret, err := db.EnrollTwoFactor(user.Id)
+	if err != nil {
+		t.Fatalf("couldnt enroll %s", err)
+	}
+	step := totpStep(time.Now())
+	code := func(offset int64) string {
+		c, _ := TOTPCode(secret, step+offset)
+		return c
+	}
+	if _, err := db.UserLogin("a@example.com", []byte("pw"), "before", time.Hour, Client{}); err != nil {
+		t.Fatalf("an unconfirmed enrollment blocked login %s", err)
+	}
+	if _, err := db.ConfirmTwoFactor(user.Id, "000000"+code(0)); err != ErrInvalidCode {
+		t.Fatalf("expected %s, got %v", ErrInvalidCode, err)
+	}
+	recovery, err := db.ConfirmTwoFactor(user.Id, code(0))
+	if err != nil || len(recovery) != recoveryCodeCount {
+		t.Fatalf("couldnt confirm %v %v", recovery, err)
+	}
+	if _, err := db.RotateRefreshToken("before", "after", time.Hour, Client{}); err == nil {
+		t.Fatalf("a session from before two-factor was enabled survived")
+	}
+	if _, err := db.EnrollTwoFactor(user.Id); err != ErrTwoFactorEnabled {
+		t.Fatalf("expected %s, got %v", ErrTwoFactorEnabled, err)
+	}
+
+	if _, err := db.UserLogin("a@example.com", []byte("pw"), "r1", time.Hour, Client{}); err != ErrTwoFactorRequired {
+		t.Fatalf("expected %s, got %v", ErrTwoFactorRequired, err)
+	}
+	if _, err := db.TwoFactorLogin(user.Id, code(0), "r1", time.Hour, Client{}); err != ErrInvalidCode {
+		t.Fatalf("accepted a replayed code, got %v", err)
+	}
+	if u, err := db.TwoFactorLogin(user.Id, code(1), "r1", time.Hour, Client{}); err != nil || u.Id != user.Id {
+		t.Fatalf("couldnt log in with a code %v %v", u, err)
+	}
+	if _, err := db.RotateRefreshToken("r1", "r2", time.Hour, Client{}); err != nil {
+		t.Fatalf("second step didnt issue a refresh token %s", err)
+	}
+	if _, err := db.TwoFactorLogin(user.Id, strings.ToUpper(recovery[0]), "r3", time.Hour, Client{}); err != nil {
+		t.Fatalf("couldnt log in with a recovery code %s", err)
+	}
+	if _, err := db.TwoFactorLogin(user.Id, recovery[0], "r4", time.Hour, Client{}); err != ErrInvalidCode {
+		t.Fatalf("a recovery code worked twice, got %v", err)
+	}
+
+	for i := 0; i < twoFactorMaxAttempts; i++ {
+		db.TwoFactorLogin(user.Id, "000000", "r5", time.Hour, Client{})
+	}
+	if _, err := db.TwoFactorLogin(user.Id, recovery[1], "r5", time.Hour, Client{}); err != ErrTwoFactorLocked {
+		t.Fatalf("expected %s after %d failures, got %v", ErrTwoFactorLocked, twoFactorMaxAttempts, err)
+	}
+
+	if err := db.ResetTwoFactor(user.Id); err != nil {
+		t.Fatalf("couldnt reset %s", err)
+	}
+	if _, err := db.RotateRefreshToken("r3", "r3b", time.Hour, Client{}); err == nil {
+		t.Fatalf("a session survived the reset")
+	}
+	if _, err := db.UserLogin("a@example.com", []byte("pw"), "r6", time.Hour, Client{}); err != nil {
+		t.Fatalf("login still needs a code after reset %s", err)
+	}
+}
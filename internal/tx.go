@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	ErrReadOnlyTx      = errors.New("write in a read-only transaction")
+	ErrVersionMismatch = errors.New("record was changed by someone else")
+)
+
+// Tx is a view of the database inside Update or View. Writes made through
+// a Tx are visible to its own reads and are committed together, as a single
+// log record, only when the Update function returns nil
+type Tx struct {
+	db       *DB
+	writable bool
+	ops      []op
+	// pending holds the records written by this transaction by table and
+	// key, a nil value is a deleted record
+	pending map[string]map[string]any
+}
+
+// Update runs fn in a read-write transaction. If fn returns an error
+// none of its writes are applied and the error is returned
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	tx := &Tx{db: db, writable: true, pending: map[string]map[string]any{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	return db.commit(tx.ops...)
+}
+
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{db: db, pending: map[string]map[string]any{}})
+}
+
+// get looks key up in the transaction's writes and then in committed
+func get[K comparable, V any](tx *Tx, table string, key K, committed map[K]V) (V, bool) {
+	if v, ok := tx.pending[table][fmt.Sprint(key)]; ok {
+		if v == nil {
+			var zero V
+			return zero, false
+		}
+		return v.(V), true
+	}
+	v, ok := committed[key]
+	return v, ok
+}
+
+// all returns committed merged with the transaction's writes to table,
+// parse turns the keys of pending writes back into map keys
+func all[K comparable, V any](tx *Tx, table string, committed map[K]V, parse func(string) (K, error)) map[K]V {
+	merged := make(map[K]V, len(committed))
+	for k, v := range committed {
+		merged[k] = v
+	}
+	for key, v := range tx.pending[table] {
+		k, err := parse(key)
+		if err != nil {
+			continue
+		}
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v.(V)
+		}
+	}
+	return merged
+}
+
+func stringKey(key string) (string, error) {
+	return key, nil
+}
+
+func (tx *Tx) put(table string, key any, v any) error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+	if tx.pending[table] == nil {
+		tx.pending[table] = map[string]any{}
+	}
+	tx.pending[table][fmt.Sprint(key)] = v
+	tx.ops = append(tx.ops, putOp(table, key, v))
+	return nil
+}
+
+func (tx *Tx) delete(table string, key any) error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+	if tx.pending[table] == nil {
+		tx.pending[table] = map[string]any{}
+	}
+	tx.pending[table][fmt.Sprint(key)] = nil
+	tx.ops = append(tx.ops, deleteOp(table, key))
+	return nil
+}
+
+// NextId advances table's sequence and returns the new ID
+func (tx *Tx) NextId(table string) (int, error) {
+	last := tx.Sequence(table)
+	return last + 1, tx.PutSequence(table, last+1)
+}
+
+// Sequence returns the last ID handed out for table
+func (tx *Tx) Sequence(table string) int {
+	last, _ := get(tx, "sequences", table, tx.db.data.Sequences)
+	return last
+}
+
+func (tx *Tx) PutSequence(table string, last int) error {
+	return tx.put("sequences", table, last)
+}
+
+func (tx *Tx) Chirp(chirpId int) (Chirp, bool) {
+	return get(tx, "chirps", chirpId, tx.db.data.Chirps)
+}
+
+// PutChirp writes chirp, which must be at the stored version or 0 when it
+// is new, and bumps its version. Read it back for the new version
+func (tx *Tx) PutChirp(chirp Chirp) error {
+	current, _ := tx.Chirp(chirp.Id)
+	if chirp.Version != current.Version {
+		return ErrVersionMismatch
+	}
+	chirp.Version++
+	return tx.put("chirps", chirp.Id, chirp)
+}
+
+// DeleteChirp removes a chirp for good, see DB.DeleteChirp for tombstones
+func (tx *Tx) DeleteChirp(chirpId int) error {
+	return tx.delete("chirps", chirpId)
+}
+
+// Chirps returns every chirp including tombstones, in no particular order
+func (tx *Tx) Chirps() []Chirp {
+	chirps := make([]Chirp, 0, len(tx.db.data.Chirps))
+	for _, chirp := range all(tx, "chirps", tx.db.data.Chirps, strconv.Atoi) {
+		chirps = append(chirps, chirp)
+	}
+	return chirps
+}
+
+// ChirpsByAuthor returns every chirp of an author including tombstones
+func (tx *Tx) ChirpsByAuthor(authorId int) []Chirp {
+	chirps := []Chirp{}
+	for id := range tx.db.index.chirpsByAuthor[authorId] {
+		if chirp, ok := tx.Chirp(id); ok && chirp.AuthorId == authorId {
+			chirps = append(chirps, chirp)
+		}
+	}
+	for _, v := range tx.pending["chirps"] {
+		if chirp, ok := v.(Chirp); ok && chirp.AuthorId == authorId {
+			if _, indexed := tx.db.index.chirpsByAuthor[authorId][chirp.Id]; !indexed {
+				chirps = append(chirps, chirp)
+			}
+		}
+	}
+	return chirps
+}
+
+func (tx *Tx) User(userId int) (User, bool) {
+	return get(tx, "users", userId, tx.db.data.Users)
+}
+
+// UserByEmail finds a user by their normalized email address
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+	email = NormalizeEmail(email)
+	for _, v := range tx.pending["users"] {
+		if user, ok := v.(User); ok && NormalizeEmail(user.Email) == email {
+			return user, true
+		}
+	}
+	if id, ok := tx.db.index.userByEmail[email]; ok {
+		if user, ok := tx.User(id); ok && NormalizeEmail(user.Email) == email {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Users returns every user, in no particular order
+func (tx *Tx) Users() []User {
+	users := make([]User, 0, len(tx.db.data.Users))
+	for _, user := range all(tx, "users", tx.db.data.Users, strconv.Atoi) {
+		users = append(users, user)
+	}
+	return users
+}
+
+// PutUser writes user, versioned like PutChirp
+func (tx *Tx) PutUser(user User) error {
+	current, _ := tx.User(user.Id)
+	if user.Version != current.Version {
+		return ErrVersionMismatch
+	}
+	user.Version++
+	return tx.put("users", user.Id, user)
+}
+
+func (tx *Tx) Password(userId int) ([]byte, bool) {
+	return get(tx, "passwords", userId, tx.db.data.Passwords)
+}
+
+func (tx *Tx) PutPassword(userId int, hash []byte) error {
+	return tx.put("passwords", userId, hash)
+}
+
+func (tx *Tx) DeletePassword(userId int) error {
+	return tx.delete("passwords", userId)
+}
+
+// Passwords returns every password hash by user ID
+func (tx *Tx) Passwords() map[int][]byte {
+	return all(tx, "passwords", tx.db.data.Passwords, strconv.Atoi)
+}
+
+// RefreshToken looks a refresh token up by its hash, see HashToken
+func (tx *Tx) RefreshToken(hash string) (RefreshToken, bool) {
+	return get(tx, "refresh_tokens", hash, tx.db.data.RefreshTokens)
+}
+
+func (tx *Tx) PutRefreshToken(hash string, rt RefreshToken) error {
+	return tx.put("refresh_tokens", hash, rt)
+}
+
+func (tx *Tx) DeleteRefreshToken(hash string) error {
+	return tx.delete("refresh_tokens", hash)
+}
+
+// RefreshTokens returns every refresh token by hash, expired ones included
+func (tx *Tx) RefreshTokens() map[string]RefreshToken {
+	return all(tx, "refresh_tokens", tx.db.data.RefreshTokens, stringKey)
+}
+
+// AccessToken looks a personal access token up by its id, the hash of the token
+func (tx *Tx) AccessToken(id string) (AccessToken, bool) {
+	return get(tx, "access_tokens", id, tx.db.data.AccessTokens)
+}
+
+func (tx *Tx) PutAccessToken(at AccessToken) error {
+	return tx.put("access_tokens", at.Id, at)
+}
+
+func (tx *Tx) DeleteAccessToken(id string) error {
+	return tx.delete("access_tokens", id)
+}
+
+// AccessTokens returns every personal access token by id, expired ones included
+func (tx *Tx) AccessTokens() map[string]AccessToken {
+	return all(tx, "access_tokens", tx.db.data.AccessTokens, stringKey)
+}
+
+func (tx *Tx) TwoFactor(userId int) (TwoFactor, bool) {
+	return get(tx, "two_factor", userId, tx.db.data.TwoFactor)
+}
+
+func (tx *Tx) PutTwoFactor(tf TwoFactor) error {
+	return tx.put("two_factor", tf.UserId, tf)
+}
+
+func (tx *Tx) DeleteTwoFactor(userId int) error {
+	return tx.delete("two_factor", userId)
+}
+
+// TwoFactors returns every two-factor enrollment by user ID
+func (tx *Tx) TwoFactors() map[int]TwoFactor {
+	return all(tx, "two_factor", tx.db.data.TwoFactor, strconv.Atoi)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateRollsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	failure := errors.New("failure")
+	err = db.Update(func(tx *Tx) error {
+		id, _ := tx.NextId("users")
+		tx.PutUser(User{Id: id, Email: "a@example.com"})
+		tx.PutPassword(id, []byte("hash"))
+		if _, ok := tx.UserByEmail("A@example.com"); !ok {
+			t.Fatalf("transaction doesnt see its own writes")
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("expected %s, got %v", failure, err)
+	}
+	db.Close()
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	defer db.Close()
+	db.View(func(tx *Tx) error {
+		if _, ok := tx.User(1); ok {
+			t.Fatalf("rolled back user was written")
+		}
+		if _, ok := tx.Password(1); ok {
+			t.Fatalf("rolled back password was written")
+		}
+		return nil
+	})
+	user, _ := db.CreateUser("b@example.com", []byte("pw"))
+	if user.Id != 1 {
+		t.Fatalf("rolled back transaction advanced the sequence to %d", user.Id)
+	}
+}
+
+func TestUpdateCommitsTogether(t *testing.T) {
+	db := NewMemoryDB()
+	err := db.Update(func(tx *Tx) error {
+		tx.PutUser(User{Id: 1, Email: "a@example.com"})
+		tx.PutChirp(Chirp{Id: 1, AuthorId: 1, Body: "hi"})
+		tx.PutChirp(Chirp{Id: 2, AuthorId: 1, Body: "there"})
+		tx.DeleteChirp(2)
+		if chirps := tx.ChirpsByAuthor(1); len(chirps) != 1 {
+			t.Fatalf("expected 1 pending chirp, got %v", chirps)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("couldnt commit %s", err)
+	}
+	if db.seq != 1 {
+		t.Fatalf("expected a single log record, got %d", db.seq)
+	}
+	if chirps, _ := db.GetChirps(ChirpsParams{AuthorId: 1}); len(chirps) != 1 {
+		t.Fatalf("expected 1 chirp, got %v", chirps)
+	}
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	db := NewMemoryDB()
+	err := db.View(func(tx *Tx) error {
+		return tx.PutUser(User{Id: 1})
+	})
+	if err != ErrReadOnlyTx {
+		t.Fatalf("expected %s, got %v", ErrReadOnlyTx, err)
+	}
+}
+
+func TestStaleWritesAreRejected(t *testing.T) {
+	db := NewMemoryDB()
+	user, _ := db.CreateUser("a@example.com", []byte("pw"))
+	if user.Version != 1 {
+		t.Fatalf("expected a new user at version 1, got %d", user.Version)
+	}
+	updated, err := db.UpdateUser(user.Id, "b@example.com", []byte("pw"), user.Version)
+	if err != nil || updated.Version != 2 {
+		t.Fatalf("expected version 2, got %v %v", updated, err)
+	}
+	if _, err := db.UpdateUser(user.Id, "c@example.com", []byte("pw"), user.Version); err != ErrVersionMismatch {
+		t.Fatalf("expected %s, got %v", ErrVersionMismatch, err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		return tx.PutUser(user)
+	})
+	if err != ErrVersionMismatch {
+		t.Fatalf("expected a write of a stale read to fail, got %v", err)
+	}
+	if current, _ := db.GetUser(user.Id); current.Email != "b@example.com" {
+		t.Fatalf("stale write went through %v", current)
+	}
+}
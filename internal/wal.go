@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// op is a change to a single record of one DBStructure table,
+// an op without a Value deletes the record
+type op struct {
+	Table string          `json:"table"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// logRecord is one entry of the write-ahead log. It holds either the ops
+// of a single change or, after a restore, a full snapshot of the database
+type logRecord struct {
+	Seq      int64           `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Ops      []op            `json:"ops,omitempty"`
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+}
+
+func putOp(table string, key any, v any) op {
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic("json error")
+	}
+	return op{Table: table, Key: fmt.Sprint(key), Value: j}
+}
+
+func deleteOp(table string, key any) op {
+	return op{Table: table, Key: fmt.Sprint(key)}
+}
+
+// apply performs o on the in-memory database
+func (d *DBStructure) apply(o op) error {
+	switch o.Table {
+	case "chirps":
+		return applyIntKey(d.Chirps, o)
+	case "users":
+		return applyIntKey(d.Users, o)
+	case "passwords":
+		return applyIntKey(d.Passwords, o)
+	case "refresh_tokens":
+		return applyStringKey(d.RefreshTokens, o)
+	case "access_tokens":
+		return applyStringKey(d.AccessTokens, o)
+	case "two_factor":
+		return applyIntKey(d.TwoFactor, o)
+	case "sequences":
+		return applyStringKey(d.Sequences, o)
+	}
+	return fmt.Errorf("unknown table %q", o.Table)
+}
+
+func applyIntKey[V any](m map[int]V, o op) error {
+	key, err := strconv.Atoi(o.Key)
+	if err != nil {
+		return err
+	}
+	if o.Value == nil {
+		delete(m, key)
+		return nil
+	}
+	var v V
+	if err := json.Unmarshal(o.Value, &v); err != nil {
+		return err
+	}
+	m[key] = v
+	return nil
+}
+
+func applyStringKey[V any](m map[string]V, o op) error {
+	if o.Value == nil {
+		delete(m, o.Key)
+		return nil
+	}
+	var v V
+	if err := json.Unmarshal(o.Value, &v); err != nil {
+		return err
+	}
+	m[o.Key] = v
+	return nil
+}
+
+// readLog decodes one record per line, decrypting lines sealed with keys.
+// A final line that doesn't decode was torn by a crash mid-append and is
+// dropped, size is the length of the valid prefix so the caller can
+// truncate the garbage away
+func readLog(r io.Reader, keys *EncryptionKeys) (records []logRecord, size int64, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, rerr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec logRecord
+			complete := line[len(line)-1] == '\n'
+			plain, oerr := keys.open(line)
+			// a whole record the keys can't open was committed, dropping it
+			// as a torn write would lose it
+			if oerr != nil && (errors.Is(oerr, errNoKeys) || complete && errors.Is(oerr, errDecrypt)) {
+				return records, size, oerr
+			}
+			if oerr != nil || json.Unmarshal(plain, &rec) != nil || !complete {
+				if _, perr := reader.Peek(1); perr == io.EOF {
+					return records, size, nil
+				}
+				return records, size, fmt.Errorf("corrupt log record after seq %d", lastSeq(records))
+			}
+			records = append(records, rec)
+		}
+		size += int64(len(line))
+		if rerr == io.EOF {
+			return records, size, nil
+		} else if rerr != nil {
+			return records, size, rerr
+		}
+	}
+}
+
+func encodeRecord(rec logRecord, keys *EncryptionKeys) ([]byte, error) {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := keys.seal(j)
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed, '\n'), nil
+}
+
+func lastSeq(records []logRecord) int64 {
+	if len(records) == 0 {
+		return 0
+	}
+	return records[len(records)-1].Seq
+}
+
+// replay rebuilds the generic JSON form of a database from a snapshot and
+// the records written after it. Working on the JSON form keeps replay
+// independent of the Go types, so old records can be migrated afterwards
+func replay(snapshot []byte, records []logRecord) (map[string]any, error) {
+	state := map[string]any{}
+	if len(snapshot) > 0 {
+		if err := json.Unmarshal(snapshot, &state); err != nil {
+			return nil, err
+		}
+	}
+	for _, rec := range records {
+		if rec.Snapshot != nil {
+			state = map[string]any{}
+			if err := json.Unmarshal(rec.Snapshot, &state); err != nil {
+				return nil, err
+			}
+		}
+		for _, o := range rec.Ops {
+			if err := applyRaw(state, o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return state, nil
+}
+
+// decodeState converts the generic JSON form of a database to a DBStructure
+func decodeState(state map[string]any) (DBStructure, error) {
+	j, err := json.Marshal(state)
+	if err != nil {
+		return emptyDB(), err
+	}
+	return decodeDB(j)
+}
+
+func applyRaw(state map[string]any, o op) error {
+	table, ok := state[o.Table].(map[string]any)
+	if !ok {
+		table = map[string]any{}
+		state[o.Table] = table
+	}
+	if o.Value == nil {
+		delete(table, o.Key)
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(o.Value, &v); err != nil {
+		return err
+	}
+	table[o.Key] = v
+	return nil
+}
+
+// stateAt rebuilds the database as it was at t from the full history,
+// starting at the last snapshot taken at or before t. Every migration logs
+// a snapshot, so the records after it all share the snapshot's version
+func stateAt(history []logRecord, t time.Time) (DBStructure, error) {
+	base := -1
+	for i, rec := range history {
+		if rec.Time.After(t) {
+			break
+		}
+		if rec.Snapshot != nil {
+			base = i
+		}
+	}
+	if base == -1 {
+		return emptyDB(), errors.New("no history before " + t.Format(time.RFC3339))
+	}
+	records := []logRecord{}
+	for _, rec := range history[base+1:] {
+		if rec.Time.After(t) {
+			break
+		}
+		records = append(records, rec)
+	}
+	state, err := replay(history[base].Snapshot, records)
+	if err != nil {
+		return emptyDB(), err
+	}
+	if _, err := migrate(state); err != nil {
+		return emptyDB(), err
+	}
+	return decodeState(state)
+}
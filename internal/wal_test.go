@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// crash releases the database without compacting, like a killed process
+func crash(db *DB) {
+	db.backend.close()
+}
+
+func TestLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	user, _ := db.CreateUser("a@example.com", []byte("hunter2"))
+	db.CreateChirp("first", user)
+	db.CreateChirp("second", user)
+	db.DeleteChirp(1, user, 0)
+	crash(db)
+
+	// a record torn by the crash is dropped on load
+	wal, _ := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	wal.Write([]byte(`{"seq":5,"time":"2024-`))
+	wal.Close()
+
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	defer reopened.Close()
+	chirps, _ := reopened.GetChirps(ChirpsParams{})
+	if len(chirps) != 1 || chirps[0].Body != "second" {
+		t.Fatalf("expected only the second chirp, got %v", chirps)
+	}
+	if _, err := reopened.CreateChirp("third", user); err != nil {
+		t.Fatalf("couldnt append after a torn record %s", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("no db %s", err)
+	}
+	for i := 0; i < compactEvery+5; i++ {
+		db.CreateChirp("chirp", User{Id: 1})
+	}
+	if size := db.backend.logSize(); size != 5 {
+		t.Fatalf("expected log size: %d actual: %d", 5, size)
+	}
+	crash(db)
+
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("couldnt reopen db %s", err)
+	}
+	defer reopened.Close()
+	chirps, _ := reopened.GetChirps(ChirpsParams{})
+	if len(chirps) != compactEvery+5 {
+		t.Fatalf("expected len: %d actual length: %d", compactEvery+5, len(chirps))
+	}
+}
+
+func TestCompactMemory(t *testing.T) {
+	db := NewMemoryDB()
+	for i := 0; i < 3*compactEvery+5; i++ {
+		db.CreateChirp("chirp", User{Id: 1})
+	}
+	records, _ := db.backend.history()
+	if len(records) > 2*compactEvery+2 {
+		t.Fatalf("memory history grew to %d records", len(records))
+	}
+	state, err := stateAt(records, time.Now())
+	if err != nil || len(state.Chirps) != 3*compactEvery+5 {
+		t.Fatalf("expected %d chirps from the history, got %d %v", 3*compactEvery+5, len(state.Chirps), err)
+	}
+}
+
+func TestRestoreTo(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db.CreateChirp("before", User{Id: 1})
+			time.Sleep(10 * time.Millisecond)
+			mark := time.Now()
+			time.Sleep(10 * time.Millisecond)
+			db.CreateChirp("after", User{Id: 1})
+
+			if err := db.RestoreTo(mark); err != nil {
+				t.Fatalf("couldnt restore %s", err)
+			}
+			chirps, _ := db.GetChirps(ChirpsParams{})
+			if len(chirps) != 1 || chirps[0].Body != "before" {
+				t.Fatalf("expected only the chirp from before the restore point, got %v", chirps)
+			}
+			if err := db.RestoreTo(time.Now()); err != nil {
+				t.Fatalf("couldnt restore %s", err)
+			}
+			if err := db.RestoreTo(mark.Add(-time.Hour)); err == nil {
+				t.Fatalf("expected restore before the history to fail")
+			}
+		})
+	}
+}
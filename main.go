@@ -13,16 +13,31 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"github.com/rowinf/chirpy/internal"
 )
 
+const (
+	// undeleteWindow is how long authors can restore a deleted chirp
+	undeleteWindow = 24 * time.Hour
+	// deletedRetention is how long chirp tombstones are kept before purging
+	deletedRetention = 30 * 24 * time.Hour
+	// refreshTokenLifetime is how long a login lasts without logging in again
+	refreshTokenLifetime = 60 * 24 * time.Hour
+)
+
 type apiConfig struct {
 	fileServerHits int
-	jwtSecret      []byte
+	jwtKeys        *internal.Keyring
 	polkaKey       string
+	adminKey       string
+	db             internal.Store
+	audit          *internal.AuditLog
+	// challengeKey signs two-factor challenges, see CreateTwoFactorChallenge
+	challengeKey []byte
 }
 
 type WebooksParams struct {
@@ -85,6 +100,25 @@ func respondWithNoContent(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// etag formats a record version as a strong entity tag
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatchVersion reads the version a client expects from If-Match,
+// 0 when there is no If-Match or it is "*"
+func ifMatchVersion(r *http.Request) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || version <= 0 {
+		return 0, errors.New("If-Match is not a version etag")
+	}
+	return version, nil
+}
+
 func CensorString(s string) string {
 	censorship := []byte("****")
 	bytes := []byte(s)
@@ -97,6 +131,10 @@ func createChirp(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	type parameters struct {
 		Body string `json:"body"`
 	}
+	user, ok := requireScope(w, r, internal.ScopeChirpsWrite)
+	if !ok {
+		return
+	}
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
@@ -110,61 +148,35 @@ func createChirp(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 		respondWithError(w, http.StatusBadRequest, "chirp longer than 140 characters")
 		return
 	}
-	claims := internal.MyCustomClaims{}
-	authorization := r.Header.Get("Authorization")
-	headerToken, herr := GetTokenFromAuthorizationHeader(authorization)
-	if herr != nil {
-		respondWithError(w, http.StatusUnauthorized, herr.Error())
-		return
-	}
-	token, err := internal.ValidateToken(headerToken, ctx.jwtSecret, &claims)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "unauthorized")
-	} else if db, dberr := internal.NewDB("./database.json"); dberr == nil {
-		if token.Valid {
-			userId, converr := strconv.Atoi(claims.Subject)
-			if converr == nil {
-				if user, err := db.GetUser(userId); err != nil {
-					respondWithError(w, 400, "unprocessable chirp")
-				} else if chirp, err := db.CreateChirp(body, user); err == nil {
-					respondWithJSON(w, http.StatusCreated, chirp)
-				} else {
-					respondWithError(w, 400, "unprocessable chirp")
-				}
-			}
-		}
+	if chirp, err := ctx.db.CreateChirp(body, user); err == nil {
+		w.Header().Set("ETag", etag(chirp.Version))
+		respondWithJSON(w, http.StatusCreated, chirp)
+	} else {
+		respondWithError(w, 400, "unprocessable chirp")
 	}
 }
 
-func getChirps(w http.ResponseWriter, r *http.Request) {
-	db, _ := internal.NewDB("./database.json")
-
+func getChirps(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	authorIdParam := r.URL.Query().Get("author_id")
 	aid, _ := strconv.Atoi(authorIdParam)
 
-	params := struct {
-		AuthorId int
-		Sort     string
-	}{
+	params := internal.ChirpsParams{
 		AuthorId: aid,
 		Sort:     r.URL.Query().Get("sort"),
 	}
-	if chirps, err := db.GetChirps(params); err == nil {
+	if chirps, err := ctx.db.GetChirps(params); err == nil {
 		respondWithJSON(w, http.StatusOK, chirps)
 	} else {
 		respondWithError(w, 400, "unprocessable chirp")
 	}
 }
 
-func getChirp(w http.ResponseWriter, r *http.Request) {
-	db, err := internal.NewDB("./database.json")
-	if err != nil {
-		panic("error database")
-	}
+func getChirp(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	chirpId, parseErr := strconv.Atoi(r.PathValue("chirpID"))
 	if parseErr != nil {
 		respondWithError(w, 404, "not found")
-	} else if chirp, err := db.GetChirp(chirpId); err == nil {
+	} else if chirp, err := ctx.db.GetChirp(chirpId); err == nil {
+		w.Header().Set("ETag", etag(chirp.Version))
 		respondWithJSON(w, http.StatusOK, chirp)
 	} else {
 		respondWithError(w, 404, "not found")
@@ -172,36 +184,80 @@ func getChirp(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteChirp(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
-	db, _ := internal.NewDB("./database.json")
 	chirpId, parseErr := strconv.Atoi(r.PathValue("chirpID"))
-	claims := internal.MyCustomClaims{}
-	authorization := r.Header.Get("Authorization")
-	headerToken, herr := GetTokenFromAuthorizationHeader(authorization)
-	if herr != nil {
-		respondWithError(w, http.StatusUnauthorized, herr.Error())
+	if parseErr != nil {
+		respondWithError(w, 404, "not found")
 		return
 	}
-	token, err := internal.ValidateToken(headerToken, ctx.jwtSecret, &claims)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "unauthorized")
-	} else if db, dberr := internal.NewDB("./database.json"); dberr == nil {
-		if token.Valid {
-			userId, converr := strconv.Atoi(claims.Subject)
-			if converr == nil {
-				if deleted := db.DeleteChirp(chirpId, userId); deleted {
-					respondWithNoContent(w)
-				} else {
-					respondWithError(w, 403, "forbidden")
-				}
-			}
-		}
+	user, ok := requireScope(w, r, internal.ScopeChirpsWrite)
+	if !ok {
+		return
+	}
+	version, verr := ifMatchVersion(r)
+	if verr != nil {
+		respondWithError(w, http.StatusPreconditionFailed, verr.Error())
+		return
 	}
+	switch err := ctx.db.DeleteChirp(chirpId, user, version); {
+	case err == nil:
+		respondWithNoContent(w)
+	case errors.Is(err, internal.ErrNotFound):
+		respondWithError(w, 404, "not found")
+	case errors.Is(err, internal.ErrForbidden):
+		respondWithError(w, 403, "forbidden")
+	case errors.Is(err, internal.ErrVersionMismatch):
+		respondWithError(w, http.StatusPreconditionFailed, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+// restoreChirp undeletes one of the caller's chirps within the undelete window
+func restoreChirp(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	chirpId, parseErr := strconv.Atoi(r.PathValue("chirpID"))
 	if parseErr != nil {
 		respondWithError(w, 404, "not found")
-	} else if chirp, err := db.GetChirp(chirpId); err == nil {
+		return
+	}
+	user, ok := requireScope(w, r, internal.ScopeChirpsWrite)
+	if !ok {
+		return
+	}
+	chirp, err := ctx.db.RestoreChirp(chirpId, user.Id, undeleteWindow)
+	switch {
+	case err == nil:
+		w.Header().Set("ETag", etag(chirp.Version))
 		respondWithJSON(w, http.StatusOK, chirp)
-	} else {
+	case errors.Is(err, internal.ErrNotFound):
 		respondWithError(w, 404, "not found")
+	case errors.Is(err, internal.ErrForbidden):
+		respondWithError(w, 403, "forbidden")
+	case errors.Is(err, internal.ErrWindowExpired):
+		respondWithError(w, http.StatusGone, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+// purgeDeletedChirps removes expired chirp tombstones until the process exits
+func purgeDeletedChirps(db internal.Store, every time.Duration) {
+	for range time.Tick(every) {
+		if n, err := db.PurgeDeletedChirps(deletedRetention); err != nil {
+			log.Printf("error purging deleted chirps: %s", err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted chirps", n)
+		}
+	}
+}
+
+// sweepRefreshTokens removes expired refresh tokens until the process exits
+func sweepRefreshTokens(db internal.Store, every time.Duration) {
+	for range time.Tick(every) {
+		if n, err := db.PurgeExpiredRefreshTokens(); err != nil {
+			log.Printf("error sweeping refresh tokens: %s", err)
+		} else if n > 0 {
+			log.Printf("swept %d expired refresh tokens", n)
+		}
 	}
 }
 
@@ -213,7 +269,19 @@ func GetTokenFromAuthorizationHeader(header string) (string, error) {
 	return strings.TrimSpace(strings.TrimPrefix(header, prefix)), nil
 }
 
+// getCurrentUser returns the caller's own user
+func getCurrentUser(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	if user, ok := requireScope(w, r, internal.ScopeUsersRead); ok {
+		w.Header().Set("ETag", etag(user.Version))
+		respondWithJSON(w, http.StatusOK, user)
+	}
+}
+
 func updateUser(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	current, ok := requireScope(w, r, internal.ScopeUsersWrite)
+	if !ok {
+		return
+	}
 	decoder := json.NewDecoder(r.Body)
 	params := UserParams{}
 	if err := decoder.Decode(&params); err != nil {
@@ -221,34 +289,21 @@ func updateUser(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
-	claims := internal.MyCustomClaims{}
-	authorization := r.Header.Get("Authorization")
-	headerToken, herr := GetTokenFromAuthorizationHeader(authorization)
-	if herr != nil {
-		respondWithError(w, http.StatusUnauthorized, herr.Error())
+	version, verr := ifMatchVersion(r)
+	if verr != nil {
+		respondWithError(w, http.StatusPreconditionFailed, verr.Error())
 		return
 	}
-	token, err := internal.ValidateToken(headerToken, ctx.jwtSecret, &claims)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "unauthorized")
-	} else if db, dberr := internal.NewDB("./database.json"); dberr == nil {
-		if token.Valid {
-			userId, converr := strconv.Atoi(claims.Subject)
-			if converr == nil {
-				user, err := db.UpdateUser(userId, params.Email, []byte(params.Password))
-				if err != nil {
-					respondWithError(w, http.StatusBadRequest, "unprocessable user")
-				} else {
-					respondWithJSON(w, http.StatusOK, user)
-				}
-			} else {
-				respondWithError(w, http.StatusBadRequest, "bad subject")
-			}
-		} else {
-			respondWithError(w, http.StatusUnauthorized, "invalid token")
-		}
+	user, err := ctx.db.UpdateUser(current.Id, params.Email, []byte(params.Password), version)
+	if errors.Is(err, internal.ErrVersionMismatch) {
+		respondWithError(w, http.StatusPreconditionFailed, err.Error())
+	} else if errors.Is(err, internal.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+	} else if err != nil {
+		respondWithError(w, http.StatusBadRequest, "unprocessable user")
 	} else {
-		respondWithError(w, http.StatusBadRequest, dberr.Error())
+		w.Header().Set("ETag", etag(user.Version))
+		respondWithJSON(w, http.StatusOK, user)
 	}
 }
 
@@ -264,13 +319,8 @@ func handleWebhooks(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	if err := decoder.Decode(&params); err != nil {
 		respondWithNoContent(w)
 	} else {
-		db, err := internal.NewDB("./database.json")
-		if err != nil {
-			panic(err)
-		}
-
 		if params.Event == "user.upgraded" {
-			if db.UpgradeUserRed(params.Data.UserId, true) {
+			if ctx.db.UpgradeUserRed(params.Data.UserId, true) {
 				respondWithNoContent(w)
 			} else {
 				respondWithError(w, http.StatusNotFound, "not found")
@@ -281,7 +331,7 @@ func handleWebhooks(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	}
 }
 
-func createUser(w http.ResponseWriter, r *http.Request) {
+func createUser(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	decoder := json.NewDecoder(r.Body)
 	params := UserParams{}
 	if err := decoder.Decode(&params); err != nil {
@@ -289,30 +339,43 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
-	db, _ := internal.NewDB("./database.json")
-	user, err := db.CreateUser(params.Email, []byte(params.Password))
+	user, err := ctx.db.CreateUser(params.Email, []byte(params.Password))
 
-	if err != nil {
+	if errors.Is(err, internal.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+	} else if err != nil {
 		respondWithError(w, http.StatusBadRequest, "unprocessable user")
 	} else {
+		w.Header().Set("ETag", etag(user.Version))
 		respondWithJSON(w, http.StatusCreated, user)
 	}
 }
 
+// newRefreshToken returns a random refresh token
+func newRefreshToken() string {
+	randoms := make([]byte, 32)
+	rand.Read(randoms)
+	return hex.EncodeToString(randoms)
+}
+
+// refreshToken exchanges a refresh token for an access token and a new
+// refresh token, the presented one cannot be used again
 func refreshToken(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	refresh, missing := internal.AuthorizationHeader(r.Header.Get("Authorization"))
 	if missing != nil {
 		respondWithError(w, http.StatusUnauthorized, missing.Error())
 		return
 	}
-	db, _ := internal.NewDB("./database.json")
-	if user, uerr := db.UserFromRefresh(refresh); uerr == nil {
-		ss, serr := internal.CreateJwt(&user, ctx.jwtSecret, 3600)
+	next := newRefreshToken()
+	if user, uerr := ctx.db.RotateRefreshToken(refresh, next, refreshTokenLifetime, clientFromRequest(r)); uerr == nil {
+		ss, serr := internal.CreateJwt(&user, ctx.jwtKeys, 3600)
 		if serr == nil {
 			payload := struct {
-				Token string `json:"token"`
+				Token        string `json:"token"`
+				RefreshToken string `json:"refresh_token"`
 			}{
-				Token: ss,
+				Token:        ss,
+				RefreshToken: next,
 			}
 			respondWithJSON(w, http.StatusOK, payload)
 		} else {
@@ -323,17 +386,26 @@ func refreshToken(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	}
 }
 
-func revokeToken(w http.ResponseWriter, r *http.Request) {
+func revokeToken(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	refresh, missing := internal.AuthorizationHeader(r.Header.Get("Authorization"))
 	if missing != nil {
 		respondWithError(w, http.StatusUnauthorized, missing.Error())
 		return
 	}
-	db, _ := internal.NewDB("./database.json")
-	db.UserRevoke(refresh)
+	ctx.db.UserRevoke(refresh)
 	respondWithJSON(w, http.StatusNoContent, nil)
 }
 
+// jwks publishes the public keys access tokens are signed with
+func jwks(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, ctx.jwtKeys.JWKS())
+}
+
+// twoFactorChallengeLifetime is how long a user has to send their
+// two-factor code after their password
+const twoFactorChallengeLifetime = 5 * time.Minute
+
 func userLogin(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 	decoder := json.NewDecoder(r.Body)
 	params := UserParams{}
@@ -342,104 +414,76 @@ func userLogin(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
 		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
-	db, _ := internal.NewDB("./database.json")
-	randoms := make([]byte, 32)
-	rand.Read(randoms)
-	refresh := hex.EncodeToString(randoms)
-	user, err := db.UserLogin(params.Email, []byte(params.Password), refresh)
-	ss, serr := internal.CreateJwt(&user, ctx.jwtSecret, params.ExpiresInSeconds)
+	refresh := newRefreshToken()
+	user, err := ctx.db.UserLogin(params.Email, []byte(params.Password), refresh, refreshTokenLifetime, clientFromRequest(r))
+	if errors.Is(err, internal.ErrTwoFactorRequired) {
+		respondWithTwoFactorChallenge(w, user, ctx)
+	} else if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "unauthorized")
+	} else {
+		respondWithLogin(w, user, refresh, params.ExpiresInSeconds, ctx)
+	}
+}
+
+// respondWithLogin issues an access token to a user who just logged in
+// with refresh
+func respondWithLogin(w http.ResponseWriter, user internal.User, refresh string, expiresInSeconds int, ctx *apiConfig) {
+	ss, serr := internal.CreateJwt(&user, ctx.jwtKeys, expiresInSeconds)
+	if serr != nil {
+		respondWithError(w, http.StatusInternalServerError, serr.Error())
+		return
+	}
 	payload := struct {
 		Id           int    `json:"id"`
 		Email        string `json:"email"`
 		Token        string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
 		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Version      int    `json:"version"`
 	}{
 		Id:           user.Id,
 		Email:        user.Email,
 		Token:        ss,
 		RefreshToken: refresh,
 		IsChirpyRed:  user.IsChirpyRed,
+		Version:      user.Version,
 	}
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "unauthorized")
-	} else if serr != nil {
-		respondWithError(w, http.StatusInternalServerError, serr.Error())
-	} else {
-		respondWithJSON(w, http.StatusOK, payload)
-	}
+	respondWithJSON(w, http.StatusOK, payload)
 }
 
-var dbg bool
+var (
+	dbg       bool
+	dbPath    string
+	port      string
+	instances instanceList
+)
 
 func init() {
 	flag.BoolVar(&dbg, "debug", false, "Enable debug mode")
+	flag.StringVar(&dbPath, "db", envOr("DB_PATH", "./database.json"), "path to the database file")
+	flag.StringVar(&port, "port", envOr("PORT", "8080"), "port to serve on")
+	flag.Var(&instances, "instance", "serve a database on its own port as PORT=PATH, repeatable, replaces -port and -db")
 }
 
 func main() {
 	godotenv.Load()
 	flag.Parse()
-	port := "8080"
-	if dbg {
-		os.Remove("./database.json")
-	}
-
-	apiConfig := apiConfig{
-		fileServerHits: 0,
-		jwtSecret:      []byte(os.Getenv("JWT_SECRET")),
-		polkaKey:       os.Getenv("POLKA_KEY"),
-	}
-	r := http.NewServeMux()
-	admin := http.NewServeMux()
-	// Create a new ServeMux
-	handler := apiConfig.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
-
-	r.HandleFunc("/app", handler)
-	r.HandleFunc("/app/*", handler)
-	r.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(http.StatusText(http.StatusOK)))
-	})
-	admin.HandleFunc("/metrics", adminMetrics(&apiConfig))
-	admin.HandleFunc("/metrics/", adminMetrics(&apiConfig))
-	admin.HandleFunc("/reset", apiConfig.handlerReset)
-	r.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
-		userLogin(w, r, &apiConfig)
-	})
-	r.HandleFunc("POST /api/polka/webhooks", func(w http.ResponseWriter, r *http.Request) {
-		handleWebhooks(w, r, &apiConfig)
-	})
-	r.HandleFunc("POST /api/users", createUser)
-	r.HandleFunc("POST /api/revoke", revokeToken)
-	r.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
-		refreshToken(w, r, &apiConfig)
-	})
-	r.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) {
-		updateUser(w, r, &apiConfig)
-	})
-	r.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
-		createChirp(w, r, &apiConfig)
-	})
-	r.HandleFunc("GET /api/chirps", getChirps)
-	r.HandleFunc("GET /api/chirps/{chirpID}", getChirp)
-	r.HandleFunc("DELETE /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
-		deleteChirp(w, r, &apiConfig)
-	})
-	r.Handle("/admin/", http.StripPrefix("/app", admin))
-	// Wrp the mux in a custom middleware for CORS
-	corsMux := addCorsHeaders(r)
-
-	// Create a new HTTP server with the corsMux as the handler
-	server := &http.Server{
-		Addr:    ":" + port, // Set the desired port
-		Handler: corsMux,
+	keys, err := internal.LoadEncryptionKeys(os.Getenv("DB_ENCRYPTION_KEYS"), os.Getenv("DB_ENCRYPTION_KEY_FILE"))
+	if err != nil {
+		log.Fatalf("error loading encryption keys: %s", err)
 	}
-
-	// Start the server
-	log.Printf("Serving files from %s on port: %s\n", ".", port)
-	if err := server.ListenAndServe(); err != nil {
-		panic(err)
+	dbOptions := internal.Options{EncryptionKeys: keys}
+	if flag.NArg() > 0 {
+		if err := runCommand(dbPath, dbOptions, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(instances) == 0 {
+		instances = instanceList{{port: port, dbPath: dbPath}}
+	}
+	if err := serve(instances, dbOptions); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// instance is one chirpy server and the database it serves
+type instance struct {
+	port   string
+	dbPath string
+}
+
+// instanceList collects repeated -instance PORT=PATH flags
+type instanceList []instance
+
+func (l *instanceList) String() string {
+	parts := []string{}
+	for _, i := range *l {
+		parts = append(parts, i.port+"="+i.dbPath)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *instanceList) Set(value string) error {
+	port, path, ok := strings.Cut(value, "=")
+	if !ok || port == "" || path == "" {
+		return fmt.Errorf("instance %q is not in the form PORT=PATH", value)
+	}
+	*l = append(*l, instance{port: port, dbPath: path})
+	return nil
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// loadJwtKeys reads the access token secrets from JWT_SECRET and the
+// signing keys from JWT_KEYS_DIR if it is set. JWT_SECRET is required
+func loadJwtKeys() (*internal.Keyring, error) {
+	secrets := os.Getenv("JWT_SECRET")
+	if strings.TrimSpace(secrets) == "" {
+		return nil, fmt.Errorf("JWT_SECRET is not set")
+	}
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		return internal.LoadKeyring(dir, secrets)
+	}
+	return internal.NewKeyring(secrets)
+}
+
+// reloadJwtKeys picks up key rotations until the process exits
+func reloadJwtKeys(keys *internal.Keyring, every time.Duration) {
+	for range time.Tick(every) {
+		if err := keys.Reload(); err != nil {
+			log.Printf("error reloading jwt keys: %s", err)
+		}
+	}
+}
+
+func newApiConfig(db internal.Store, jwtKeys *internal.Keyring) (*apiConfig, error) {
+	challengeKey, err := internal.NewChallengeKey()
+	if err != nil {
+		return nil, fmt.Errorf("error creating two-factor challenge key: %w", err)
+	}
+	return &apiConfig{
+		fileServerHits: 0,
+		jwtKeys:        jwtKeys,
+		polkaKey:       os.Getenv("POLKA_KEY"),
+		adminKey:       os.Getenv("ADMIN_KEY"),
+		db:             db,
+		audit:          internal.NewMemoryAuditLog(),
+		challengeKey:   challengeKey,
+	}, nil
+}
+
+// serve opens each instance's database and serves it on its port until
+// one of the servers fails. Instances share nothing but the environment
+// and the keys access tokens are signed with
+func serve(instances instanceList, opts internal.Options) error {
+	jwtKeys, err := loadJwtKeys()
+	if err != nil {
+		return fmt.Errorf("error loading jwt keys: %w", err)
+	}
+	go reloadJwtKeys(jwtKeys, time.Minute)
+
+	errs := make(chan error, len(instances))
+	for _, inst := range instances {
+		if dbg {
+			if err := internal.RemoveDB(inst.dbPath); err != nil {
+				return fmt.Errorf("error removing database %s: %w", inst.dbPath, err)
+			}
+		}
+		db, err := internal.OpenDB(inst.dbPath, opts)
+		if err != nil {
+			return fmt.Errorf("error opening database %s: %w", inst.dbPath, err)
+		}
+		defer db.Close()
+		audit, err := internal.OpenAuditLog(inst.dbPath + ".audit")
+		if err != nil {
+			return fmt.Errorf("error opening audit log %s: %w", inst.dbPath+".audit", err)
+		}
+		defer audit.Close()
+		go purgeDeletedChirps(db, time.Hour)
+		go sweepRefreshTokens(db, 10*time.Minute)
+
+		cfg, err := newApiConfig(db, jwtKeys)
+		if err != nil {
+			return err
+		}
+		cfg.audit = audit
+		server := &http.Server{
+			Addr:    ":" + inst.port,
+			Handler: cfg.routes(),
+		}
+		log.Printf("Serving %s on port: %s\n", inst.dbPath, inst.port)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	return <-errs
+}
+
+// routes returns the handler for one instance, wrapped for CORS
+func (cfg *apiConfig) routes() http.Handler {
+	r := http.NewServeMux()
+	handler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
+
+	r.HandleFunc("/app", handler)
+	r.HandleFunc("/app/*", handler)
+	r.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		jwks(w, r, cfg)
+	})
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	})
+	r.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
+		userLogin(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		twoFactorLogin(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/polka/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		handleWebhooks(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/users", func(w http.ResponseWriter, r *http.Request) {
+		createUser(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/revoke", func(w http.ResponseWriter, r *http.Request) {
+		revokeToken(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
+		refreshToken(w, r, cfg)
+	})
+	r.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) {
+		updateUser(w, r, cfg)
+	})
+	r.HandleFunc("GET /api/users/me", func(w http.ResponseWriter, r *http.Request) {
+		getCurrentUser(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
+		createChirp(w, r, cfg)
+	})
+	r.HandleFunc("GET /api/chirps", func(w http.ResponseWriter, r *http.Request) {
+		getChirps(w, r, cfg)
+	})
+	r.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
+		getChirp(w, r, cfg)
+	})
+	r.HandleFunc("DELETE /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
+		deleteChirp(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/chirps/{chirpID}/restore", func(w http.ResponseWriter, r *http.Request) {
+		restoreChirp(w, r, cfg)
+	})
+	r.HandleFunc("GET /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		listSessions(w, r, cfg)
+	})
+	r.HandleFunc("DELETE /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		revokeAllSessions(w, r, cfg)
+	})
+	r.HandleFunc("DELETE /api/sessions/{sessionID}", func(w http.ResponseWriter, r *http.Request) {
+		revokeSession(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		createAccessToken(w, r, cfg)
+	})
+	r.HandleFunc("GET /api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		listAccessTokens(w, r, cfg)
+	})
+	r.HandleFunc("DELETE /api/tokens/{tokenID}", func(w http.ResponseWriter, r *http.Request) {
+		revokeAccessToken(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/2fa", func(w http.ResponseWriter, r *http.Request) {
+		enrollTwoFactor(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/2fa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		confirmTwoFactor(w, r, cfg)
+	})
+	r.HandleFunc("POST /api/2fa/recovery-codes", func(w http.ResponseWriter, r *http.Request) {
+		regenerateRecoveryCodes(w, r, cfg)
+	})
+	r.HandleFunc("DELETE /api/2fa", func(w http.ResponseWriter, r *http.Request) {
+		disableTwoFactor(w, r, cfg)
+	})
+	r.Handle("/admin/", cfg.adminRoutes())
+	// Wrp the mux in a custom middleware for CORS
+	return addCorsHeaders(cfg.authenticate(r))
+}
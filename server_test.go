@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+func testJwtKeys(t *testing.T) *internal.Keyring {
+	keys, err := internal.NewKeyring("test:0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf("no jwt keys %s", err)
+	}
+	return keys
+}
+
+// testServer is the api over an in-memory database, for handler tests
+type testServer struct {
+	db      *internal.DB
+	cfg     *apiConfig
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	db := internal.NewMemoryDB()
+	cfg, err := newApiConfig(db, testJwtKeys(t))
+	if err != nil {
+		t.Fatalf("no api config %s", err)
+	}
+	return &testServer{db: db, cfg: cfg, handler: cfg.routes()}
+}
+
+// do sends a request with body, and authorization as the Authorization
+// header unless it is empty
+func (s *testServer) do(method string, path string, authorization string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	return w
+}
+
+// token returns an access token for user
+func (s *testServer) token(t *testing.T, user internal.User) string {
+	token, err := internal.CreateJwt(&user, s.cfg.jwtKeys, 0)
+	if err != nil {
+		t.Fatalf("no access token %s", err)
+	}
+	return token
+}
+
+func TestInstanceFlag(t *testing.T) {
+	l := instanceList{}
+	if err := l.Set("8081=/tmp/a.json"); err != nil {
+		t.Fatalf("valid instance rejected %s", err)
+	}
+	if err := l.Set("8082"); err == nil {
+		t.Fatalf("instance without a path accepted")
+	}
+	if len(l) != 1 || l[0].port != "8081" || l[0].dbPath != "/tmp/a.json" {
+		t.Fatalf("wrong instances %v", l)
+	}
+}
+
+func TestInstancesAreIsolated(t *testing.T) {
+	dir := t.TempDir()
+	servers := []http.Handler{}
+	for _, name := range []string{"a.json", "b.json"} {
+		db, err := internal.NewDB(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("no db %s", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		cfg, err := newApiConfig(db, testJwtKeys(t))
+		if err != nil {
+			t.Fatalf("no api config %s", err)
+		}
+		servers = append(servers, cfg.routes())
+	}
+	for _, server := range servers {
+		req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"email":"a@example.com","password":"pw"}`))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected each instance to create the user, got %d %s", w.Code, w.Body)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := s.db.CreateUser("a@example.com", []byte("pw"))
+	token := s.token(t, user)
+
+	put := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/users", strings.NewReader(`{"email":"b@example.com","password":"pw"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		return w
+	}
+	w := put(etag(user.Version))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag(user.Version+1) {
+		t.Fatalf("expected 200 with the next etag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := put(etag(user.Version)); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected a stale If-Match to fail, got %d", w.Code)
+	}
+	if w := put("*"); w.Code != http.StatusOK {
+		t.Fatalf("expected If-Match * to succeed, got %d", w.Code)
+	}
+}
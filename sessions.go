@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// clientFromRequest describes the device a request comes from for the
+// session list. The IP is the peer address, proxies are not trusted
+func clientFromRequest(r *http.Request) internal.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return internal.Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	if sessions, err := ctx.db.Sessions(user.Id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	} else {
+		respondWithJSON(w, http.StatusOK, sessions)
+	}
+}
+
+func revokeSession(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	err := ctx.db.RevokeSession(user.Id, r.PathValue("sessionID"))
+	if errors.Is(err, internal.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "not found")
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	} else {
+		respondWithNoContent(w)
+	}
+}
+
+// revokeAllSessions logs the user out everywhere, access tokens
+// already issued stay valid until they expire
+func revokeAllSessions(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	if n, err := ctx.db.RevokeAllSessions(user.Id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	} else {
+		respondWithJSON(w, http.StatusOK, struct {
+			Revoked int `json:"revoked"`
+		}{n})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// newAccessToken returns a random personal access token
+func newAccessToken() string {
+	return internal.AccessTokenPrefix + newRefreshToken()
+}
+
+// createAccessToken mints a personal access token for the caller, the
+// token itself is only ever returned here
+func createAccessToken(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	params := struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	token := newAccessToken()
+	ttl := time.Duration(params.ExpiresInSeconds) * time.Second
+	if at, err := ctx.db.CreateAccessToken(user.Id, token, params.Name, params.Scopes, ttl); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	} else {
+		respondWithJSON(w, http.StatusCreated, struct {
+			internal.AccessToken
+			Token string `json:"token"`
+		}{at, token})
+	}
+}
+
+func listAccessTokens(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	if tokens, err := ctx.db.AccessTokens(user.Id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	} else {
+		respondWithJSON(w, http.StatusOK, tokens)
+	}
+}
+
+func revokeAccessToken(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	err := ctx.db.RevokeAccessToken(user.Id, r.PathValue("tokenID"))
+	if errors.Is(err, internal.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "not found")
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	} else {
+		respondWithNoContent(w)
+	}
+}
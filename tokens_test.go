@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+func TestAccessTokens(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := s.db.CreateUser("admin@example.com", []byte("pw"))
+	user, _ = s.db.SetUserRoles(user.Id, []string{internal.RoleAdmin}, 0)
+	jwt := s.token(t, user)
+
+	do := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		return s.do(method, path, "Bearer "+token, body)
+	}
+	w := do("POST", "/api/tokens", jwt, `{"name":"ci","scopes":["chirps:write"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("couldnt create token %d %s", w.Code, w.Body)
+	}
+	created := struct {
+		Id    string `json:"id"`
+		Token string `json:"token"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	pat := created.Token
+	if do("POST", "/api/tokens", jwt, `{"name":"ci","scopes":["root"]}`).Code != http.StatusBadRequest {
+		t.Fatalf("created a token with an unknown scope")
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/api/chirps", `{"body":"from ci"}`, http.StatusCreated},
+		{"GET", "/api/users/me", "", http.StatusForbidden},
+		{"PUT", "/api/users", `{"email":"x@example.com","password":"pw"}`, http.StatusForbidden},
+		{"POST", "/api/tokens", `{"name":"more","scopes":["chirps:write"]}`, http.StatusForbidden},
+		{"GET", "/api/sessions", "", http.StatusForbidden},
+		// tokens act without the user's roles
+		{"GET", "/admin/users", "", http.StatusForbidden},
+	} {
+		if w := do(c.method, c.path, pat, c.body); w.Code != c.want {
+			t.Fatalf("%s %s: expected %d, got %d %s", c.method, c.path, c.want, w.Code, w.Body)
+		}
+	}
+
+	tokens := []internal.AccessToken{}
+	json.Unmarshal(do("GET", "/api/tokens", jwt, "").Body.Bytes(), &tokens)
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil || tokens[0].Name != "ci" {
+		t.Fatalf("expected the token to be listed as used, got %v", tokens)
+	}
+	if w := do("DELETE", "/api/tokens/"+created.Id, jwt, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("couldnt revoke token %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/api/chirps", pat, `{"body":"after revoke"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked token to be refused, got %d", w.Code)
+	}
+}
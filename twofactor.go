@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+// twoFactorIssuer names chirpy in authenticator apps
+const twoFactorIssuer = "Chirpy"
+
+type twoFactorParams struct {
+	Code string `json:"code"`
+}
+
+// respondWithTwoFactorError maps the errors of the two-factor store
+// methods to statuses
+func respondWithTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrInvalidCode):
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, internal.ErrTwoFactorLocked):
+		respondWithError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, internal.ErrTwoFactorEnabled):
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, internal.ErrTwoFactorNotEnrolled):
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, internal.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, "not found")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Internal Server Error")
+	}
+}
+
+// respondWithTwoFactorChallenge answers the first step of a login for
+// users with two-factor authentication, no tokens are issued until they
+// send a code along with the challenge to /api/login/2fa
+func respondWithTwoFactorChallenge(w http.ResponseWriter, user internal.User, ctx *apiConfig) {
+	challenge, err := internal.CreateTwoFactorChallenge(&user, ctx.challengeKey, twoFactorChallengeLifetime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, struct {
+		Id                int    `json:"id"`
+		Email             string `json:"email"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		Challenge         string `json:"challenge"`
+	}{user.Id, user.Email, true, challenge})
+}
+
+// twoFactorLogin is the second step of a login, it exchanges the
+// challenge and a TOTP or recovery code for the tokens
+func twoFactorLogin(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	params := struct {
+		Challenge        string `json:"challenge"`
+		Code             string `json:"code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	userId, err := internal.ValidateTwoFactorChallenge(params.Challenge, ctx.challengeKey)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired challenge, log in again")
+		return
+	}
+	refresh := newRefreshToken()
+	if user, err := ctx.db.TwoFactorLogin(userId, params.Code, refresh, refreshTokenLifetime, clientFromRequest(r)); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithLogin(w, user, refresh, params.ExpiresInSeconds, ctx)
+	}
+}
+
+// enrollTwoFactor starts enrolling the caller, the secret only guards
+// logins once confirmed with a code by confirmTwoFactor
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	if secret, err := ctx.db.EnrollTwoFactor(user.Id); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusCreated, struct {
+			Secret     string `json:"secret"`
+			OtpauthURI string `json:"otpauth_uri"`
+		}{secret, internal.TOTPURI(secret, twoFactorIssuer, user.Email)})
+	}
+}
+
+// confirmTwoFactor enables two-factor authentication and returns the
+// recovery codes, which are never shown again
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	params := twoFactorParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if codes, err := ctx.db.ConfirmTwoFactor(user.Id, params.Code); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusOK, struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes})
+	}
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	params := twoFactorParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if codes, err := ctx.db.RegenerateRecoveryCodes(user.Id, params.Code); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithJSON(w, http.StatusOK, struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes})
+	}
+}
+
+// disableTwoFactor turns two-factor authentication off for the caller
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	user, ok := requireLogin(w, r)
+	if !ok {
+		return
+	}
+	params := twoFactorParams{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if err := ctx.db.DisableTwoFactor(user.Id, params.Code); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithNoContent(w)
+	}
+}
+
+// resetTwoFactor turns two-factor authentication off for a user who
+// lost their authenticator and recovery codes
+func resetTwoFactor(w http.ResponseWriter, r *http.Request, ctx *apiConfig) {
+	userId, parseErr := strconv.Atoi(r.PathValue("userID"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err := ctx.db.ResetTwoFactor(userId); err != nil {
+		respondWithTwoFactorError(w, err)
+	} else {
+		respondWithNoContent(w)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rowinf/chirpy/internal"
+)
+
+func TestTwoFactorLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.adminKey = "admin-secret"
+	user, _ := s.db.CreateUser("a@example.com", []byte("pw"))
+	jwt := s.token(t, user)
+
+	do := func(method string, path string, authorization string, body string, into any) int {
+		w := s.do(method, path, authorization, body)
+		if into != nil {
+			json.Unmarshal(w.Body.Bytes(), into)
+		}
+		return w.Code
+	}
+	enrollment := struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}{}
+	if code := do("POST", "/api/2fa", "Bearer "+jwt, "", &enrollment); code != http.StatusCreated || !strings.HasPrefix(enrollment.OtpauthURI, "otpauth://totp/") {
+		t.Fatalf("couldnt enroll %d %v", code, enrollment)
+	}
+	step := time.Now().Unix() / 30
+	totp := func(offset int64) string {
+		c, _ := internal.TOTPCode(enrollment.Secret, step+offset)
+		return c
+	}
+	confirmed := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	if code := do("POST", "/api/2fa/confirm", "Bearer "+jwt, fmt.Sprintf(`{"code":%q}`, totp(0)), &confirmed); code != http.StatusOK || len(confirmed.RecoveryCodes) == 0 {
+		t.Fatalf("couldnt confirm %d %v", code, confirmed)
+	}
+
+	login := struct {
+		Token             string `json:"token"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		Challenge         string `json:"challenge"`
+	}{}
+	do("POST", "/api/login", "", `{"email":"a@example.com","password":"pw"}`, &login)
+	if !login.TwoFactorRequired || login.Token != "" || login.Challenge == "" {
+		t.Fatalf("expected a challenge instead of tokens, got %v", login)
+	}
+	if code := do("GET", "/api/users/me", "Bearer "+login.Challenge, "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("the challenge worked as an access token, got %d", code)
+	}
+	if _, err := internal.ValidateToken(login.Challenge, s.cfg.jwtKeys, &internal.MyCustomClaims{}); err == nil {
+		t.Fatalf("the challenge verified against the published keys")
+	}
+	if code := do("POST", "/api/login/2fa", "", fmt.Sprintf(`{"challenge":%q,"code":%q}`, login.Challenge, totp(0)), nil); code != http.StatusUnauthorized {
+		t.Fatalf("accepted a replayed code, got %d", code)
+	}
+	if code := do("POST", "/api/login/2fa", "", fmt.Sprintf(`{"challenge":%q,"code":%q}`, jwt, totp(1)), nil); code != http.StatusUnauthorized {
+		t.Fatalf("accepted an access token as the challenge, got %d", code)
+	}
+	if code := do("POST", "/api/login/2fa", "", fmt.Sprintf(`{"challenge":%q,"code":%q}`, login.Challenge, confirmed.RecoveryCodes[0]), &login); code != http.StatusOK || login.Token == "" {
+		t.Fatalf("couldnt finish login with a recovery code %d %v", code, login)
+	}
+
+	if code := do("DELETE", fmt.Sprintf("/admin/users/%d/2fa", user.Id), "Bearer "+jwt, "", nil); code != http.StatusForbidden {
+		t.Fatalf("a user reset two-factor through the admin api, got %d", code)
+	}
+	if code := do("DELETE", fmt.Sprintf("/admin/users/%d/2fa", user.Id), "ApiKey admin-secret", "", nil); code != http.StatusNoContent {
+		t.Fatalf("couldnt reset two-factor %d", code)
+	}
+	login.Token = ""
+	if do("POST", "/api/login", "", `{"email":"a@example.com","password":"pw"}`, &login); login.Token == "" {
+		t.Fatalf("login still needs a code after the reset")
+	}
+}